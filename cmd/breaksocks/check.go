@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/breaksocks/breaksocks/dnsproxy"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"net"
+	"os"
+	"strconv"
+)
+
+// runCheck loads a config and everything it refers to without listening or
+// connecting
+func runCheck(args []string) {
+	fs := newFlagSet("check", "")
+	cfg_file := fs.String("conf", "config.yaml", "config file")
+	server := fs.Bool("server", false, "the config is a server config")
+	route_addr := fs.String("route", "", "print the route rule that host:port would hit")
+	fs.Parse(args)
+
+	if *server {
+		checkServerConfig(*cfg_file)
+	} else {
+		checkClientConfig(*cfg_file, *route_addr)
+	}
+	fmt.Printf("%s: ok\n", *cfg_file)
+}
+
+func checkServerConfig(path string) {
+	cfg, err := tunnel.LoadServerConfig(path)
+	if err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	if _, err := tunnel.GetUserConfigs(cfg.UserConfigPath); err != nil {
+		fatalf("users %s: %v", cfg.UserConfigPath, err)
+	}
+	if _, err := tunnel.LoadPrivateKey(cfg.KeyPath); os.IsNotExist(err) {
+		fmt.Printf("key %s not found, the server will generate one\n", cfg.KeyPath)
+	} else if err != nil {
+		fatalf("key %s: %v", cfg.KeyPath, err)
+	}
+	if err := tunnel.CheckCiphers(cfg.LinkEncryptMethods, cfg.MinimumSecurity); err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	if _, err := tunnel.NewTransport(&cfg.TransportConfig, true); err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	if cfg.GlobalEncryptMethod != "" {
+		if err := tunnel.CheckGlobalCipher(cfg.GlobalEncryptMethod, cfg.MinimumSecurity); err != nil {
+			fatalf("%s: %v", path, err)
+		}
+		if _, err := tunnel.LoadGlobalCipherConfig(cfg.GlobalEncryptMethod,
+			[]byte(cfg.GlobalEncryptPassword)); err != nil {
+			fatalf("%s: %v", path, err)
+		}
+	}
+}
+
+func checkClientConfig(path, route_addr string) {
+	cfg, err := tunnel.LoadClientConfig(path)
+	if err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	cli, err := tunnel.NewClient(cfg)
+	if err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	if _, err := loadSocksAuth(cfg); err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	if cfg.DNSListenAddr != "" {
+		if ser, err := dnsproxy.NewServer(cfg, cli); err != nil {
+			fatalf("%s: %v", path, err)
+		} else {
+			ser.Close()
+		}
+	}
+	if route_addr != "" {
+		printRoute(cli, route_addr)
+	}
+}
+
+func printRoute(cli *tunnel.Client, addr string) {
+	host, port_s, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port_s = addr, "80"
+	}
+	port, err := strconv.Atoi(port_s)
+	if err != nil {
+		fatalf("invalid port: %s", port_s)
+	}
+	action, rule := cli.Route(host, port)
+	fmt.Printf("%s:%d => %s (%s)\n", host, port, action, rule)
+}
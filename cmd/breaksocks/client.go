@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/breaksocks/breaksocks/dnsproxy"
+	"github.com/breaksocks/breaksocks/socks5"
+	"github.com/breaksocks/breaksocks/tproxy"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"github.com/golang/glog"
+	"time"
+)
+
+// frontEnd is a local listener over the shared tunnel client
+type frontEnd struct {
+	name  string
+	serve func(ctx context.Context) error
+	// waits for or closes the running conns, may be nil
+	shutdown func(ctx context.Context) error
+}
+
+func runClient(args []string) {
+	fs := newFlagSet("client", "")
+	cfg_file := fs.String("conf", "config.yaml", "client config file")
+	shutdown_timeout := fs.Duration("shutdown-timeout", 30*time.Second,
+		"max time to wait for running connections on exit")
+	fs.Parse(args)
+
+	serveClient(*cfg_file, *shutdown_timeout, false)
+}
+
+// serveClient runs the front ends enabled in the config at cfg_file, only
+// the DNS one if dns_only
+func serveClient(cfg_file string, shutdown_timeout time.Duration, dns_only bool) {
+	cfg, err := tunnel.LoadClientConfig(cfg_file)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	cli, err := tunnel.NewClient(cfg)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if err := cli.Init(); err != nil {
+		glog.Fatal(err)
+	}
+
+	var fronts []*frontEnd
+	if !dns_only {
+		fronts, err = newFrontEnds(cfg, cli)
+	} else if len(cfg.DNSFakeIPRanges) > 0 {
+		err = fmt.Errorf("fake-ip DNS needs the redirect listener, run the client command")
+	} else if cfg.DNSListenAddr != "" {
+		var ser *dnsproxy.Server
+		if ser, err = dnsproxy.NewServer(cfg, cli); err == nil {
+			fronts = append(fronts, newDNSFrontEnd(ser))
+		}
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if len(fronts) == 0 {
+		glog.Fatal("no front end is configured")
+	}
+
+	ctx := signalContext()
+	exit_ch := make(chan bool, len(fronts))
+	for _, front := range fronts {
+		go func(front *frontEnd) {
+			defer func() {
+				exit_ch <- true
+			}()
+			glog.Infof("%s front end started", front.name)
+			if err := front.serve(ctx); err != nil {
+				glog.Fatalf("%s fail: %v", front.name, err)
+			}
+		}(front)
+	}
+	for range fronts {
+		<-exit_ch
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer scancel()
+	for _, front := range fronts {
+		if front.shutdown == nil {
+			continue
+		}
+		if err := front.shutdown(sctx); err != nil {
+			glog.Warningf("%s shutdown: %v", front.name, err)
+		}
+	}
+	if err := cli.Shutdown(sctx); err != nil {
+		glog.Warningf("client shutdown: %v", err)
+	}
+}
+
+// newFrontEnds makes a front end for every listen address in cfg
+func newFrontEnds(cfg *tunnel.ClientConfig, cli *tunnel.Client) ([]*frontEnd, error) {
+	var fronts []*frontEnd
+	methods, err := loadSocksAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SocksListenAddr != "" {
+		ser, err := socks5.NewSocks5ServerWithMethods(cfg.SocksListenAddr, cli, methods)
+		if err != nil {
+			return nil, fmt.Errorf("create socks5server fail: %v", err)
+		}
+		fronts = append(fronts, &frontEnd{
+			name:     "socks5",
+			serve:    serveUntilClosed(ser.Serve, socks5.ErrServerClosed),
+			shutdown: ser.Shutdown})
+	}
+
+	if cfg.HTTPListenAddr != "" {
+		ser, err := socks5.NewHTTPProxyServerWithMethods(cfg.HTTPListenAddr, cli, methods)
+		if err != nil {
+			return nil, fmt.Errorf("create http proxy fail: %v", err)
+		}
+		fronts = append(fronts, &frontEnd{
+			name:     "http",
+			serve:    serveUntilClosed(ser.Serve, socks5.ErrServerClosed),
+			shutdown: ser.Shutdown})
+	}
+
+	if cfg.TProxyListenAddr != "" {
+		udp_timeout := cfg.TProxyUDPTimeout
+		if udp_timeout <= 0 {
+			udp_timeout = 60 * time.Second
+		}
+		ser, err := tproxy.NewServer(cfg.TProxyListenAddr, cli, udp_timeout)
+		if err != nil {
+			return nil, fmt.Errorf("create tproxy server fail: %v", err)
+		}
+		fronts = append(fronts, &frontEnd{
+			name:  "tproxy",
+			serve: serveUntilClosed(ser.Serve, tproxy.ErrServerClosed)})
+	}
+
+	// the redirect listener maps the fake IPs of the DNS front end back
+	var fake_ip *dnsproxy.FakeIP
+	if cfg.DNSListenAddr != "" {
+		ser, err := dnsproxy.NewServer(cfg, cli)
+		if err != nil {
+			return nil, fmt.Errorf("create dns server fail: %v", err)
+		}
+		fake_ip = ser.FakeIP()
+		fronts = append(fronts, newDNSFrontEnd(ser))
+	}
+
+	if cfg.RedirListenAddr != "" {
+		ser, err := newRedirServer(cfg.RedirListenAddr, cli, fake_ip)
+		if err != nil {
+			return nil, fmt.Errorf("create redirect server fail: %v", err)
+		}
+		fronts = append(fronts, &frontEnd{name: "redirect", serve: ser.serve})
+	}
+	return fronts, nil
+}
+
+// serveUntilClosed makes serve return nil instead of closed_err
+func serveUntilClosed(serve func(context.Context) error, closed_err error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := serve(ctx); err != closed_err {
+			return err
+		}
+		return nil
+	}
+}
+
+// loadSocksAuth returns the auth methods of the socks5 server and the http
+// proxy
+func loadSocksAuth(cfg *tunnel.ClientConfig) ([]socks5.SocksAuthMethod, error) {
+	if len(cfg.SocksNoAuthCIDR) == 0 && cfg.SocksUserFile == "" {
+		return []socks5.SocksAuthMethod{&socks5.NoAuth{}}, nil
+	}
+
+	var methods []socks5.SocksAuthMethod
+	if len(cfg.SocksNoAuthCIDR) > 0 {
+		no_auth, err := socks5.NewNoAuth(cfg.SocksNoAuthCIDR)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, no_auth)
+	}
+	if cfg.SocksUserFile != "" {
+		users, err := socks5.LoadSimpleAuth(cfg.SocksUserFile)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, socks5.NewUserPasswdAuth(users))
+	}
+	return methods, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"github.com/breaksocks/breaksocks/dnsproxy"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func runDNS(args []string) {
+	fs := newFlagSet("dns", "")
+	cfg_file := fs.String("conf", "config.yaml", "client config file")
+	shutdown_timeout := fs.Duration("shutdown-timeout", 30*time.Second,
+		"max time to wait for running queries on exit")
+	fs.Parse(args)
+
+	serveClient(*cfg_file, *shutdown_timeout, true)
+}
+
+func newDNSFrontEnd(ser *dnsproxy.Server) *frontEnd {
+	if cache := ser.Cache(); cache != nil {
+		go handleCacheSignals(cache)
+	}
+	return &frontEnd{
+		name:  "dns",
+		serve: ser.Serve,
+		shutdown: func(ctx context.Context) error {
+			return ser.Close()
+		}}
+}
+
+// handleCacheSignals logs the cache stats on SIGUSR1 and flushes it on SIGHUP
+func handleCacheSignals(cache *dnsproxy.Cache) {
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, syscall.SIGUSR1, syscall.SIGHUP)
+	for sig := range sig_ch {
+		if sig == syscall.SIGHUP {
+			cache.Flush()
+			glog.Info("dns cache flushed")
+			continue
+		}
+		stats := cache.Stats()
+		glog.Infof("dns cache: %d entries, %d hits, %d misses, %d prefetches, %d stale",
+			stats.Size, stats.Hits, stats.Misses, stats.Prefetches, stats.StaleHits)
+	}
+}
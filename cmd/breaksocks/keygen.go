@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"os"
+	"strings"
+	"time"
+)
+
+func runKeygen(args []string) {
+	action := "gen"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+
+	switch action {
+	case "gen":
+		keygenGen(args)
+	case "fingerprint":
+		keygenFingerprint(args)
+	case "export":
+		keygenExport(args)
+	case "rotate":
+		keygenRotate(args)
+	default:
+		fatalf("unknown keygen action: %s (gen, fingerprint, export or rotate)", action)
+	}
+}
+
+func printFingerprint(pub crypto.PublicKey, path string) {
+	fp, err := tunnel.KeyFingerprint(pub)
+	if err != nil {
+		fatalf("%s: %v", path, err)
+	}
+	fmt.Printf("%s %s\n", fp, path)
+}
+
+func keygenGen(args []string) {
+	fs := newFlagSet("keygen gen", "")
+	out := fs.String("out", "rsa_key", "private key path, the public key is written to <out>.pub")
+	key_type := fs.String("type", "rsa", "key type, rsa, ed25519 or ecdsa (P-256)")
+	bits := fs.Int("bits", 2048, "RSA key size")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*out); err == nil {
+		fatalf("%s exists, use keygen rotate to replace a server key", *out)
+	}
+	key, err := tunnel.GenerateKey(*key_type, *bits, *out)
+	if err != nil {
+		fatalf("generate key fail: %v", err)
+	}
+	printFingerprint(key.Public(), *out)
+}
+
+func keygenFingerprint(args []string) {
+	fs := newFlagSet("keygen fingerprint", "<key file>...")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range fs.Args() {
+		pub, err := tunnel.LoadPublicKey(path)
+		if err != nil {
+			fatalf("%s: %v", path, err)
+		}
+		printFingerprint(pub, path)
+	}
+}
+
+func keygenExport(args []string) {
+	fs := newFlagSet("keygen export", "")
+	key_path := fs.String("key", "rsa_key", "server private key")
+	out := fs.String("out", "", "public key path for ServerPublicKeyPath, <key>.pub if empty")
+	fs.Parse(args)
+	if *out == "" {
+		*out = *key_path + ".pub"
+	}
+
+	pub, err := tunnel.LoadPublicKey(*key_path)
+	if err != nil {
+		fatalf("%s: %v", *key_path, err)
+	}
+	if err := tunnel.SavePublicKey(pub, *out); err != nil {
+		fatalf("%s: %v", *out, err)
+	}
+	printFingerprint(pub, *out)
+}
+
+// keygenRotate moves the key to <key>.old and generates a new one, the old
+// key endorses the new one in <key>.rotation for the clients that pinned it
+func keygenRotate(args []string) {
+	fs := newFlagSet("keygen rotate", "")
+	key_path := fs.String("key", "rsa_key", "server private key")
+	key_type := fs.String("type", "", "type of the new key, rsa, ed25519 or ecdsa, the type of the old key if empty")
+	bits := fs.Int("bits", 2048, "RSA key size")
+	grace := fs.Duration("grace", 7*24*time.Hour, "how long the clients that pinned the old key trust the new one")
+	fs.Parse(args)
+
+	old, err := tunnel.LoadPrivateKey(*key_path)
+	if err != nil {
+		fatalf("%s: %v", *key_path, err)
+	}
+	if *key_type == "" {
+		*key_type = tunnel.KeyType(old.Public())
+	}
+
+	old_path := *key_path + ".old"
+	// a second rotation within the grace period would lose the old key
+	if _, err := os.Stat(old_path); err == nil {
+		fatalf("%s exists, remove it once the clients trust the current key", old_path)
+	}
+	if err := os.Rename(*key_path, old_path); err != nil {
+		fatalf("%v", err)
+	}
+	if err := os.Rename(*key_path+".pub", old_path+".pub"); err != nil && !os.IsNotExist(err) {
+		os.Rename(old_path, *key_path)
+		fatalf("%v", err)
+	}
+	// put the old key back, the pinned clients are locked out otherwise
+	rollback := func(format string, args ...interface{}) {
+		os.Remove(*key_path + ".rotation")
+		os.Rename(old_path, *key_path)
+		if err := os.Rename(old_path+".pub", *key_path+".pub"); os.IsNotExist(err) {
+			os.Remove(*key_path + ".pub")
+		}
+		fatalf(format, args...)
+	}
+	key, err := tunnel.GenerateKey(*key_type, *bits, *key_path)
+	if err != nil {
+		rollback("generate key fail: %v", err)
+	}
+	// the server loads the key the same way
+	if _, err := tunnel.LoadPrivateKey(*key_path); err != nil {
+		rollback("load the new key fail: %v", err)
+	}
+
+	rotation, err := tunnel.NewKeyRotation(old, key.Public(), time.Now().Add(*grace))
+	if err == nil {
+		err = tunnel.SaveKeyRotation(rotation, *key_path+".rotation")
+	}
+	if err != nil {
+		rollback("endorse the new key fail: %v", err)
+	}
+
+	printFingerprint(old.Public(), old_path)
+	printFingerprint(key.Public(), *key_path)
+	fmt.Printf("the old key is trusted until %s, restart the server and give %s.pub to the clients\n",
+		rotation.Expire.Format(time.RFC3339), *key_path)
+}
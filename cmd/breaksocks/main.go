@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands = []*command{
+	{"client", "run the local proxy front ends over the tunnel", runClient},
+	{"server", "run the tunnel server", runServer},
+	{"dns", "run only the DNS front end of a client config", runDNS},
+	{"keygen", "generate a server key", runKeygen},
+	{"user", "manage the server users file", runUser},
+	{"check", "check a config file", runCheck},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [log flags] <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nlog flags:\n")
+	flag.PrintDefaults()
+}
+
+// newFlagSet makes the flags of a command, the log flags are accepted after
+// the command too
+func newFlagSet(name, args_usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [flags] %s\n", os.Args[0], name, args_usage)
+		fs.PrintDefaults()
+	}
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// signalContext is done on SIGINT or SIGTERM
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		glog.Infof("got signal %v, shutting down", <-sig_ch)
+		cancel()
+	}()
+	return ctx
+}
+
+// fatalf reports an error of a command line tool and exits
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			cmd.run(flag.Args()[1:])
+			glog.Flush()
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"github.com/breaksocks/breaksocks/dnsproxy"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"github.com/golang/glog"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// getsockopt names of the original destination of a REDIRECT conn, from
+// linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// redirServer connects the conns redirected by iptables to their original
+// destinations, the conns to the fake IPs of fake_ip to their domains
+type redirServer struct {
+	l       *net.TCPListener
+	cli     *tunnel.Client
+	fake_ip *dnsproxy.FakeIP
+}
+
+func newRedirServer(addr string, cli *tunnel.Client, fake_ip *dnsproxy.FakeIP) (*redirServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redirServer{l: l.(*net.TCPListener), cli: cli, fake_ip: fake_ip}, nil
+}
+
+func (s *redirServer) serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.l.Close()
+	}()
+
+	for {
+		conn, err := s.l.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		ip, port, err := originalDst(conn)
+		if err != nil {
+			glog.Errorf("get dest addr of %v fail: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		if s.fake_ip != nil && s.fake_ip.Contains(ip) {
+			domain, ok := s.fake_ip.LookupIP(ip)
+			if !ok {
+				glog.Warningf("fake ip %v of %v has no domain", ip, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			glog.V(1).Infof("got cli: %v (%s, %d)", conn.RemoteAddr(), domain, port)
+			go s.cli.DoDomainProxy(domain, port, conn)
+			continue
+		}
+		addr := ip.To4()
+		if addr == nil {
+			addr = ip.To16()
+		}
+		glog.V(1).Infof("got cli: %v (%v, %d)", conn.RemoteAddr(), ip, port)
+		go s.cli.DoIPProxy(addr, port, conn)
+	}
+}
+
+// parseSockaddrIn decodes a struct sockaddr_in: family[2] port[2] addr[4],
+// the port is in network order
+func parseSockaddrIn(b []byte) (net.IP, int) {
+	return net.IPv4(b[4], b[5], b[6], b[7]), int(b[2])<<8 | int(b[3])
+}
+
+// parseSockaddrIn6 decodes a struct sockaddr_in6: family[2] port[2]
+// flowinfo[4] addr[16] scope_id[4], the port is in network order
+func parseSockaddrIn6(b []byte) (net.IP, int) {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, b[8:24])
+	return ip, int(b[2])<<8 | int(b[3])
+}
+
+// originalDst returns the destination of a conn redirected by iptables
+func originalDst(conn *net.TCPConn) (net.IP, int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	is_v6 := false
+	if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+		is_v6 = true
+	}
+
+	var ip net.IP
+	var port int
+	var opt_err error
+	err = raw.Control(func(fd uintptr) {
+		if is_v6 {
+			// struct sockaddr_in6 is the first field of struct ip6_mtuinfo
+			var info *syscall.IPv6MTUInfo
+			if info, opt_err = syscall.GetsockoptIPv6MTUInfo(int(fd),
+				syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST); opt_err == nil {
+				raw := (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))
+				ip, port = parseSockaddrIn6(raw[:])
+			}
+		} else {
+			// struct ipv6_mreq (20 bytes) is larger than struct sockaddr_in
+			// (16 bytes), the kernel accepts the larger optlen and fills the
+			// first 16 bytes, which are all in Multiaddr
+			var mreq *syscall.IPv6Mreq
+			if mreq, opt_err = syscall.GetsockoptIPv6Mreq(int(fd),
+				syscall.IPPROTO_IP, SO_ORIGINAL_DST); opt_err == nil {
+				ip, port = parseSockaddrIn(mreq.Multiaddr[:])
+			}
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if opt_err != nil {
+		return nil, 0, os.NewSyscallError("getsockopt", opt_err)
+	}
+	return ip, port, nil
+}
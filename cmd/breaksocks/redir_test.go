@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSockaddr(t *testing.T) {
+	// AF_INET, port 8080, 10.1.2.3, zero padding
+	in := []byte{2, 0, 0x1f, 0x90, 10, 1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0}
+	if ip, port := parseSockaddrIn(in); !ip.Equal(net.IPv4(10, 1, 2, 3)) || port != 8080 {
+		t.Error("sockaddr_in", ip, port)
+	}
+
+	// AF_INET6, port 443, flowinfo, 2001:db8::1, scope id
+	in6 := []byte{10, 0, 0x01, 0xbb, 1, 2, 3, 4}
+	in6 = append(in6, net.ParseIP("2001:db8::1")...)
+	in6 = append(in6, 5, 0, 0, 0)
+	if ip, port := parseSockaddrIn6(in6); !ip.Equal(net.ParseIP("2001:db8::1")) || port != 443 {
+		t.Error("sockaddr_in6", ip, port)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func runServer(args []string) {
+	fs := newFlagSet("server", "")
+	cfg_file := fs.String("conf", "config.yaml", "server config file")
+	pid_file := fs.String("pidfile", "", "write the pid here for user -reload")
+	shutdown_timeout := fs.Duration("shutdown-timeout", 30*time.Second,
+		"max time to wait for running connections on exit")
+	fs.Parse(args)
+
+	cfg, err := tunnel.LoadServerConfig(*cfg_file)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	ser, err := tunnel.NewServer(cfg)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if *pid_file != "" {
+		if err := ioutil.WriteFile(*pid_file, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			glog.Fatalf("write pid file fail: %v", err)
+		}
+		defer os.Remove(*pid_file)
+	}
+	go reloadUsersOnHUP(ser)
+
+	ctx := signalContext()
+	if err := ser.Serve(ctx); err != tunnel.ErrServerClosed {
+		glog.Fatalf("serve fail: %v", err)
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), *shutdown_timeout)
+	defer scancel()
+	if err := ser.Shutdown(sctx); err != nil {
+		glog.Warningf("shutdown: %v", err)
+	}
+}
+
+// reloadUsersOnHUP rereads the users file on SIGHUP
+func reloadUsersOnHUP(ser *tunnel.Server) {
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, syscall.SIGHUP)
+	for range sig_ch {
+		if err := ser.ReloadUsers(); err != nil {
+			glog.Errorf("reload users fail: %v", err)
+		} else {
+			glog.Info("users reloaded")
+		}
+	}
+}
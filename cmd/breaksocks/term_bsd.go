@@ -0,0 +1,12 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// ioctl requests of the terminal settings
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
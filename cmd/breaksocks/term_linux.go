@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// ioctl requests of the terminal settings
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
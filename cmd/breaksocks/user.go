@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// max username and password sizes of a login request
+const (
+	maxUsernameSize = 32
+	maxPasswordSize = 32
+)
+
+const userActions = "add, remove, passwd, enable, disable, set-limits or list"
+
+func runUser(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fatalf("usage: %s user <%s> [flags] [name]", os.Args[0], strings.Replace(userActions, ", ", "|", -1))
+	}
+	action, args := args[0], args[1:]
+	switch action {
+	case "add", "remove", "passwd", "enable", "disable", "set-limits", "list":
+	default:
+		fatalf("unknown user action: %s (%s)", action, userActions)
+	}
+
+	args_usage := "<name>"
+	if action == "list" {
+		args_usage = ""
+	}
+	fs := newFlagSet("user "+action, args_usage)
+	users_file := fs.String("users", "users", "server users file")
+	reload := fs.String("reload", "", "pid file of a running server to reload the users")
+	var max_tunnels, max_conns *int
+	if action == "add" || action == "set-limits" {
+		max_tunnels = fs.Int("max-tunnels", 0, "max concurrent tunnels, 0 is unlimited")
+		max_conns = fs.Int("max-conns", 0, "max concurrent proxied connections, 0 is unlimited")
+	}
+	fs.Parse(args)
+	name := fs.Arg(0)
+	if (args_usage == "") != (fs.NArg() == 0) || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	users, err := tunnel.GetUserConfigs(*users_file)
+	if os.IsNotExist(err) && action == "add" {
+		users, err = tunnel.NewUserConfigs(*users_file), nil
+	}
+	if err != nil {
+		fatalf("load users fail: %v", err)
+	}
+	user := users.Get(name)
+	if user == nil && action != "add" && action != "list" {
+		fatalf("no such user: %s", name)
+	}
+
+	switch action {
+	case "list":
+		listUsers(users)
+		return
+	case "add":
+		if user != nil {
+			fatalf("user %s exists", name)
+		}
+		if len(name) > maxUsernameSize {
+			fatalf("username size must be at most %d", maxUsernameSize)
+		}
+		user = new(tunnel.UserConfig)
+		setPassword(user)
+		user.MaxTunnels, user.MaxConns = *max_tunnels, *max_conns
+	case "remove":
+		users.Delete(name)
+	case "passwd":
+		setPassword(user)
+	case "enable", "disable":
+		user.Disabled = action == "disable"
+	case "set-limits":
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "max-tunnels":
+				user.MaxTunnels = *max_tunnels
+			case "max-conns":
+				user.MaxConns = *max_conns
+			}
+		})
+	}
+	if action != "remove" {
+		users.Set(name, user)
+	}
+
+	if err := users.Save(); err != nil {
+		fatalf("save users fail: %v", err)
+	}
+	if *reload != "" {
+		if err := signalServer(*reload, syscall.SIGHUP); err != nil {
+			fatalf("reload server fail: %v", err)
+		}
+	}
+}
+
+func listUsers(users *tunnel.UserConfigs) {
+	for _, name := range users.Names() {
+		user := users.Get(name)
+		if user == nil {
+			user = new(tunnel.UserConfig)
+		}
+		status := "enabled"
+		if user.Disabled {
+			status = "disabled"
+		}
+		if user.PasswordHash == "" && user.Password != "" {
+			status += ",plaintext"
+		}
+		fmt.Printf("%s\t%s\tmax-tunnels=%s\tmax-conns=%s\n",
+			name, status, limitString(user.MaxTunnels), limitString(user.MaxConns))
+	}
+}
+
+func limitString(limit int) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(limit)
+}
+
+func setPassword(user *tunnel.UserConfig) {
+	passwd, err := readNewPassword()
+	if err != nil {
+		fatalf("read password fail: %v", err)
+	}
+	if err := user.SetPassword(passwd); err != nil {
+		fatalf("hash password fail: %v", err)
+	}
+}
+
+// readNewPassword reads the password twice without echo from a terminal, or
+// once from the first line of a non terminal stdin
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	term, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		passwd, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && passwd == "" {
+			return "", err
+		}
+		return checkPassword(strings.TrimRight(passwd, "\r\n"))
+	}
+
+	noecho := *term
+	noecho.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &noecho); err != nil {
+		return "", err
+	}
+	defer unix.IoctlSetTermios(fd, ioctlSetTermios, term)
+
+	reader := bufio.NewReader(os.Stdin)
+	var passwds [2]string
+	for i, prompt := range []string{"password: ", "again: "} {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := reader.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passwds[i] = strings.TrimRight(line, "\r\n")
+	}
+	if passwds[0] != passwds[1] {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return checkPassword(passwds[0])
+}
+
+func checkPassword(passwd string) (string, error) {
+	if passwd == "" || len(passwd) > maxPasswordSize {
+		return "", fmt.Errorf("password size must be 1 to %d", maxPasswordSize)
+	}
+	return passwd, nil
+}
+
+// signalServer sends sig to the pid in pid_file
+func signalServer(pid_file string, sig syscall.Signal) error {
+	data, err := ioutil.ReadFile(pid_file)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pid file %s", pid_file)
+	}
+	return syscall.Kill(pid, sig)
+}
@@ -0,0 +1,266 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"context"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxCacheTTL    = 24 * time.Hour
+	maxNegativeTTL = 3 * time.Hour
+	// TTL of the stale answers, RFC 8767
+	staleTTL = 30
+	// an entry with 2 hits is refreshed in the last 10% of its TTL
+	prefetchHits    = 2
+	prefetchPercent = 10
+)
+
+// Exchanger answers queries, Forwarder and Cache implement it
+type Exchanger interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+type CacheStats struct {
+	Size       int
+	Hits       uint64
+	Misses     uint64
+	Prefetches uint64
+	StaleHits  uint64
+}
+
+// Cache answers queries from the responses of next until their TTL expires,
+// NXDOMAIN/NODATA responses are cached with the SOA TTL (RFC 2308). Expired
+// entries are kept for stale and served if next fails.
+type Cache struct {
+	next     Exchanger
+	size     int
+	stale    time.Duration
+	prefetch bool
+
+	lock    sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	ttl         time.Duration
+	hits        int
+	prefetching bool
+}
+
+func NewCache(next Exchanger, size int, stale time.Duration, prefetch bool) *Cache {
+	return &Cache{
+		next:     next,
+		size:     size,
+		stale:    stale,
+		prefetch: prefetch,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New()}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
+
+func (c *Cache) Flush() {
+	c.lock.Lock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.lock.Unlock()
+}
+
+func (c *Cache) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
+	resp, err := c.Exchange(context.Background(), msg)
+	if err != nil {
+		dns.HandleFailed(w, msg)
+		return
+	}
+	writeResponse(w, msg, resp)
+}
+
+func (c *Cache) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return c.next.Exchange(ctx, msg)
+	}
+	key := cacheKey{
+		name:   strings.ToLower(msg.Question[0].Name),
+		qtype:  msg.Question[0].Qtype,
+		qclass: msg.Question[0].Qclass}
+
+	now := time.Now()
+	c.lock.Lock()
+	var stale *dns.Msg
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		age := now.Sub(entry.stored)
+		if age < entry.ttl {
+			entry.hits++
+			c.stats.Hits++
+			c.lru.MoveToFront(elem)
+			if c.prefetch && !entry.prefetching && entry.hits >= prefetchHits &&
+				entry.ttl-age < entry.ttl*prefetchPercent/100 {
+				entry.prefetching = true
+				c.stats.Prefetches++
+				go c.refresh(key, msg)
+			}
+			resp := answerFromCache(entry.msg, msg, age, 0)
+			c.lock.Unlock()
+			return resp, nil
+		}
+		if age < entry.ttl+c.stale {
+			stale = answerFromCache(entry.msg, msg, age, staleTTL)
+		} else {
+			c.removeElement(elem)
+		}
+	}
+	c.stats.Misses++
+	c.lock.Unlock()
+
+	resp, err := c.next.Exchange(ctx, msg)
+	if err != nil {
+		if stale != nil {
+			glog.V(1).Infof("serve stale %s: %v", key.name, err)
+			c.lock.Lock()
+			c.stats.StaleHits++
+			c.lock.Unlock()
+			return stale, nil
+		}
+		return nil, err
+	}
+	c.store(key, resp)
+	return resp, nil
+}
+
+// refresh queries next for a hot entry before it expires
+func (c *Cache) refresh(key cacheKey, query *dns.Msg) {
+	msg := query.Copy()
+	msg.Id = dns.Id()
+	resp, err := c.next.Exchange(context.Background(), msg)
+	if err != nil {
+		glog.V(1).Infof("prefetch %s fail: %v", key.name, err)
+		c.lock.Lock()
+		if elem, ok := c.entries[key]; ok {
+			elem.Value.(*cacheEntry).prefetching = false
+		}
+		c.lock.Unlock()
+		return
+	}
+	c.store(key, resp)
+}
+
+func (c *Cache) store(key cacheKey, resp *dns.Msg) {
+	ttl, ok := cacheTTL(resp)
+	if !ok || ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	msg := resp.Copy()
+	// OPT is added again for each query
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	entry := &cacheEntry{key: key, msg: msg, stored: time.Now(), ttl: ttl}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *Cache) removeElement(elem *list.Element) {
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+	c.lru.Remove(elem)
+}
+
+// cacheTTL returns how long resp can be cached, false if it must not be
+func cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		var min_ttl uint32 = 1<<32 - 1
+		for _, sec := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+			for _, rr := range sec {
+				if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < min_ttl {
+					min_ttl = rr.Header().Ttl
+				}
+			}
+		}
+		ttl := time.Duration(min_ttl) * time.Second
+		if ttl > maxCacheTTL {
+			ttl = maxCacheTTL
+		}
+		return ttl, true
+	case resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess:
+		// negative answer, the TTL is the smaller of the SOA TTL and MINIMUM
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				min_ttl := soa.Hdr.Ttl
+				if soa.Minttl < min_ttl {
+					min_ttl = soa.Minttl
+				}
+				ttl := time.Duration(min_ttl) * time.Second
+				if ttl > maxNegativeTTL {
+					ttl = maxNegativeTTL
+				}
+				return ttl, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// answerFromCache makes the answer to query from a cached msg of the given
+// age, a non zero ttl replaces the TTLs
+func answerFromCache(cached, query *dns.Msg, age time.Duration, ttl uint32) *dns.Msg {
+	resp := cached.Copy()
+	resp.Id = query.Id
+	resp.Question = query.Question
+	elapsed := uint32(age / time.Second)
+	for _, sec := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range sec {
+			hdr := rr.Header()
+			if ttl != 0 {
+				hdr.Ttl = ttl
+			} else if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	if opt := query.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), false)
+	}
+	return resp
+}
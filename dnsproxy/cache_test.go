@@ -0,0 +1,97 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// fakeExchanger answers "<name> A 10.0.0.1" with TTL 60, "nx." with NXDOMAIN
+type fakeExchanger struct {
+	queries int
+	fail    bool
+}
+
+func (e *fakeExchanger) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	e.queries++
+	if e.fail {
+		return nil, errors.New("upstream down")
+	}
+	resp := new(dns.Msg).SetReply(msg)
+	if msg.Question[0].Name == "nx." {
+		resp.Rcode = dns.RcodeNameError
+		soa, _ := dns.NewRR(". 3600 IN SOA a. b. 1 2 3 4 300")
+		resp.Ns = append(resp.Ns, soa)
+	} else {
+		rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 10.0.0.1")
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp, nil
+}
+
+func (c *Cache) backdate(name string, age time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, elem := range c.entries {
+		if key.name == name {
+			elem.Value.(*cacheEntry).stored = time.Now().Add(-age)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	next := new(fakeExchanger)
+	cache := NewCache(next, 2, time.Hour, false)
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		resp, err := cache.Exchange(context.Background(), msg)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if resp.Id != msg.Id {
+			t.Error("id mismatch", resp.Id, msg.Id)
+		}
+		return resp
+	}
+
+	query("a.test.")
+	cache.backdate("a.test.", 20*time.Second)
+	resp := query("A.Test.")
+	if next.queries != 1 {
+		t.Error("expect cache hit, queries", next.queries)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 40 {
+		t.Error("expect ttl 40, got", ttl)
+	}
+
+	// NXDOMAIN is cached with the SOA MINIMUM
+	query("nx.")
+	resp = query("nx.")
+	if resp.Rcode != dns.RcodeNameError || next.queries != 2 {
+		t.Error("negative cache", resp.Rcode, next.queries)
+	}
+	if ttl, ok := cacheTTL(resp); !ok || ttl != 300*time.Second {
+		t.Error("negative ttl", ttl)
+	}
+
+	// expired, served stale when the upstream fails
+	cache.backdate("a.test.", 2*time.Minute)
+	next.fail = true
+	if resp := query("a.test."); resp.Answer[0].Header().Ttl != staleTTL {
+		t.Error("expect stale answer", resp)
+	}
+	next.fail = false
+
+	// the LRU keeps 2 entries
+	query("b.test.")
+	query("c.test.")
+	if stats := cache.Stats(); stats.Size != 2 || stats.StaleHits != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	cache.Flush()
+	if stats := cache.Stats(); stats.Size != 0 {
+		t.Errorf("stats after flush %+v", stats)
+	}
+}
@@ -0,0 +1,117 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// tlsDialer makes TLS conns over the conns of dialer
+type tlsDialer struct {
+	dialer Dialer
+	config *tls.Config
+}
+
+func (d *tlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Client(conn, d.config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// NewTLSUpstream is a TCPUpstream over TLS (RFC 7858), the server name is
+// the host of addr if config has none
+func NewTLSUpstream(addr string, dialer Dialer, n_streams int, config *tls.Config) *TCPUpstream {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	u := NewTCPUpstream(addr, &tlsDialer{dialer: dialer, config: config}, n_streams)
+	u.scheme = "tls"
+	return u
+}
+
+// HTTPSUpstream posts queries to a DNS over HTTPS url (RFC 8484), the
+// HTTP/2 or keep-alive conns are reused
+type HTTPSUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSUpstream(url string, dialer Dialer, config *tls.Config) *HTTPSUpstream {
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     config,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &HTTPSUpstream{url: url, client: &http.Client{Transport: transport}}
+}
+
+func (u *HTTPSUpstream) String() string {
+	return u.url
+}
+
+func (u *HTTPSUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// ID 0 makes the responses cacheable by HTTP caches
+	query := msg.Copy()
+	query.Id = 0
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("dnsproxy: %s: %s", u.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	reply.Id = msg.Id
+	return reply, nil
+}
+
+// Close closes the idle conns
+func (u *HTTPSUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,100 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func answerA(msg *dns.Msg, addr string) *dns.Msg {
+	resp := new(dns.Msg).SetReply(msg)
+	rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A " + addr)
+	resp.Answer = append(resp.Answer, rr)
+	return resp
+}
+
+func TestSecureUpstreams(t *testing.T) {
+	var doh_ids int32
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		msg := new(dns.Msg)
+		if r.Header.Get("Content-Type") != dnsMessageType || msg.Unpack(body) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if msg.Id != 0 {
+			atomic.AddInt32(&doh_ids, 1)
+		}
+		data, _ := answerA(msg, "10.0.0.1").Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(data)
+	}))
+	defer doh.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteMsg(answerA(msg, "10.0.0.2"))
+	})}
+	go dot.ActivateAndServe()
+	defer dot.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+	config := &tls.Config{RootCAs: roots}
+	https_dialer, tls_dialer := new(countDialer), new(countDialer)
+	https_up := NewHTTPSUpstream(doh.URL+"/dns-query", https_dialer, config)
+	defer https_up.Close()
+	tls_up := NewTLSUpstream(l.Addr().String(), tls_dialer, 1, config)
+	defer tls_up.Close()
+
+	exchange := func(up Upstream, want string) {
+		msg := new(dns.Msg).SetQuestion("a.test.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		resp, err := up.Exchange(ctx, msg)
+		if err != nil {
+			t.Fatal(up, err)
+		}
+		if resp.Id != msg.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != want {
+			t.Error(up, resp)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		exchange(https_up, "10.0.0.1")
+		exchange(tls_up, "10.0.0.2")
+	}
+	if n := atomic.LoadInt32(&https_dialer.dials); n != 1 {
+		t.Error("expect 1 https conn, got", n)
+	}
+	if n := atomic.LoadInt32(&tls_dialer.dials); n != 1 {
+		t.Error("expect 1 tls conn, got", n)
+	}
+	if n := atomic.LoadInt32(&doh_ids); n != 0 {
+		t.Error("expect doh queries with id 0, got", n)
+	}
+
+	// the dead one fails at once and the slower tls one loses
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	exchange(NewRaceUpstream([]Upstream{
+		NewTCPUpstream(dead.Addr().String(), new(countDialer), 1), tls_up, https_up}), "10.0.0.1")
+
+	if up, err := NewUpstream("tls://dns.example", nil, 1); err != nil || up.String() != "tls://dns.example:853" {
+		t.Error("tls upstream", up, err)
+	}
+	if up, err := NewUpstream("8.8.8.8:53", nil, 1); err != nil || up.String() != "udp://8.8.8.8:53" {
+		t.Error("direct upstream", up, err)
+	}
+}
@@ -0,0 +1,177 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+)
+
+// TTL of the fake answers, a mapping may be reused after it is evicted
+const fakeTTL = 1
+
+// FakeIP answers A/AAAA queries with addresses from reserved ranges and
+// remembers the domain of each address, so the conns to a fake IP can be
+// connected to the domain. The least recently used mapping is reused when
+// the ranges or size run out. Other queries go to next.
+type FakeIP struct {
+	next  Exchanger
+	pool4 *fakePool
+	pool6 *fakePool
+	size  int
+
+	lock    sync.Mutex
+	by_name map[string]*list.Element
+	by_ip   map[string]*list.Element
+	lru     *list.List
+}
+
+type fakeEntry struct {
+	name string
+	ip4  net.IP
+	ip6  net.IP
+}
+
+// fakePool hands out the addresses of ipnet in order
+type fakePool struct {
+	ipnet *net.IPNet
+	// usable addresses, the first and last are skipped
+	n    uint64
+	next uint64
+}
+
+// NewFakeIP takes an IPv4 and an optional IPv6 range in cidrs, at most size
+// mappings are kept
+func NewFakeIP(cidrs []string, size int, next Exchanger) (*FakeIP, error) {
+	if size <= 0 {
+		size = 65536
+	}
+	f := &FakeIP{
+		next:    next,
+		size:    size,
+		by_name: make(map[string]*list.Element),
+		by_ip:   make(map[string]*list.Element),
+		lru:     list.New()}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones < 2 {
+			return nil, fmt.Errorf("dnsproxy: fake ip range %s too small", cidr)
+		}
+		pool := &fakePool{ipnet: ipnet, n: uint64(size)}
+		if bits-ones < 32 {
+			if avail := uint64(1)<<uint(bits-ones) - 2; avail < pool.n {
+				pool.n = avail
+			}
+		}
+		if ipnet.IP.To4() != nil {
+			f.pool4 = pool
+		} else {
+			f.pool6 = pool
+		}
+	}
+	if f.pool4 == nil {
+		return nil, fmt.Errorf("dnsproxy: no IPv4 fake ip range")
+	}
+	return f, nil
+}
+
+// Contains reports whether ip is in the fake ranges
+func (f *FakeIP) Contains(ip net.IP) bool {
+	return f.pool4.ipnet.Contains(ip) || (f.pool6 != nil && f.pool6.ipnet.Contains(ip))
+}
+
+// LookupIP returns the domain of a fake ip, false if it has no mapping
+func (f *FakeIP) LookupIP(ip net.IP) (string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	elem, ok := f.by_ip[string(ip.To16())]
+	if !ok {
+		return "", false
+	}
+	f.lru.MoveToFront(elem)
+	return elem.Value.(*fakeEntry).name, true
+}
+
+// lookupName returns the mapping of name, a new one is allocated if needed
+func (f *FakeIP) lookupName(name string) *fakeEntry {
+	name = normalizeName(name)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if elem, ok := f.by_name[name]; ok {
+		f.lru.MoveToFront(elem)
+		return elem.Value.(*fakeEntry)
+	}
+
+	entry := &fakeEntry{name: name}
+	if f.lru.Len() >= f.size || f.pool4.next >= f.pool4.n ||
+		(f.pool6 != nil && f.pool6.next >= f.pool6.n) {
+		old := f.lru.Remove(f.lru.Back()).(*fakeEntry)
+		delete(f.by_name, old.name)
+		delete(f.by_ip, string(old.ip4.To16()))
+		entry.ip4 = old.ip4
+		if old.ip6 != nil {
+			delete(f.by_ip, string(old.ip6))
+			entry.ip6 = old.ip6
+		}
+	} else {
+		entry.ip4 = f.pool4.alloc()
+		if f.pool6 != nil {
+			entry.ip6 = f.pool6.alloc()
+		}
+	}
+
+	elem := f.lru.PushFront(entry)
+	f.by_name[name] = elem
+	f.by_ip[string(entry.ip4.To16())] = elem
+	if entry.ip6 != nil {
+		f.by_ip[string(entry.ip6)] = elem
+	}
+	return entry
+}
+
+func (p *fakePool) alloc() net.IP {
+	p.next++
+	ip := make(net.IP, len(p.ipnet.IP))
+	copy(ip, p.ipnet.IP)
+	carry := p.next
+	for i := len(ip) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ip[i]) + carry&0xFF
+		ip[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return ip
+}
+
+func (f *FakeIP) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 || msg.Question[0].Qclass != dns.ClassINET {
+		return f.next.Exchange(ctx, msg)
+	}
+	q := msg.Question[0]
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+	default:
+		return f.next.Exchange(ctx, msg)
+	}
+
+	entry := f.lookupName(q.Name)
+	resp := addrAnswer(msg, []net.IP{entry.ip4, entry.ip6})
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = fakeTTL
+	}
+	return resp, nil
+}
+
+func (f *FakeIP) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
+	resp, err := f.Exchange(context.Background(), msg)
+	if err != nil {
+		dns.HandleFailed(w, msg)
+		return
+	}
+	writeResponse(w, msg, resp)
+}
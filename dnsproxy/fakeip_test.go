@@ -0,0 +1,62 @@
+package dnsproxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestFakeIP(t *testing.T) {
+	next := new(fakeExchanger)
+	fake, err := NewFakeIP([]string{"198.18.0.0/15", "fc00::/64"}, 2, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) net.IP {
+		resp, err := fake.Exchange(context.Background(), new(dns.Msg).SetQuestion(name, qtype))
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatal(name, err, resp)
+		}
+		switch rr := resp.Answer[0].(type) {
+		case *dns.A:
+			return rr.A
+		case *dns.AAAA:
+			return rr.AAAA
+		}
+		return nil
+	}
+
+	ip := query("a.example.", dns.TypeA)
+	if !ip.Equal(net.ParseIP("198.18.0.1")) {
+		t.Error("first fake ip", ip)
+	}
+	if ip6 := query("A.example.", dns.TypeAAAA); !ip6.Equal(net.ParseIP("fc00::1")) {
+		t.Error("first fake ipv6", ip6)
+	}
+	if domain, ok := fake.LookupIP(net.ParseIP("fc00::1")); !ok || domain != "a.example" {
+		t.Error("lookup ipv6", domain, ok)
+	}
+	if ip2 := query("b.example.", dns.TypeA); !ip2.Equal(net.ParseIP("198.18.0.2")) {
+		t.Error("second fake ip", ip2)
+	}
+
+	// a.example is used last, b.example is evicted for c.example
+	if domain, ok := fake.LookupIP(ip); !ok || domain != "a.example" {
+		t.Error("lookup", domain, ok)
+	}
+	if ip3 := query("c.example.", dns.TypeA); !ip3.Equal(net.ParseIP("198.18.0.2")) {
+		t.Error("reused fake ip", ip3)
+	}
+	if domain, _ := fake.LookupIP(net.ParseIP("198.18.0.2")); domain != "c.example" {
+		t.Error("lookup reused", domain)
+	}
+	if !fake.Contains(net.ParseIP("198.19.255.1")) || fake.Contains(net.ParseIP("10.0.0.1")) {
+		t.Error("contains")
+	}
+
+	// other queries go to next
+	if _, err := fake.Exchange(context.Background(), new(dns.Msg).SetQuestion("a.example.", dns.TypeMX)); err != nil || next.queries != 1 {
+		t.Error("MX query", err, next.queries)
+	}
+}
@@ -0,0 +1,78 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// Forwarder sends every query to the upstreams, a failed or timed out query
+// is retried on the next upstream
+type Forwarder struct {
+	upstreams []Upstream
+	timeout   time.Duration
+	retries   int
+}
+
+func NewForwarder(upstreams []Upstream, timeout time.Duration, retries int) (*Forwarder, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("dnsproxy: no upstream")
+	}
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return &Forwarder{upstreams: upstreams, timeout: timeout, retries: retries}, nil
+}
+
+func (f *Forwarder) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var last_err error
+	for i := 0; i <= f.retries; i++ {
+		up := f.upstreams[i%len(f.upstreams)]
+		qctx, cancel := context.WithTimeout(ctx, f.timeout)
+		resp, err := up.Exchange(qctx, msg)
+		cancel()
+		if err == nil {
+			return resp, nil
+		}
+		glog.V(1).Infof("dns query %s via %s fail: %v", queryName(msg), up, err)
+		last_err = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, last_err
+}
+
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
+	resp, err := f.Exchange(context.Background(), msg)
+	if err != nil {
+		dns.HandleFailed(w, msg)
+		return
+	}
+	writeResponse(w, msg, resp)
+}
+
+// writeResponse truncates resp to the UDP size of the query if needed
+func writeResponse(w dns.ResponseWriter, query, resp *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	w.WriteMsg(resp)
+}
+
+func queryName(msg *dns.Msg) string {
+	if len(msg.Question) == 0 {
+		return "<empty>"
+	}
+	return msg.Question[0].Name
+}
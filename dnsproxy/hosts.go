@@ -0,0 +1,63 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Hosts is a static table of names to addresses
+type Hosts struct {
+	addrs map[string][]net.IP
+}
+
+func NewHosts() *Hosts {
+	return &Hosts{addrs: make(map[string][]net.IP)}
+}
+
+// LoadHosts loads a file in the /etc/hosts format
+func LoadHosts(path string) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := NewHosts()
+	scanner := bufio.NewScanner(f)
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expect ip and names", path, line_no)
+		}
+		for _, name := range fields[1:] {
+			h.Add(name, ip)
+		}
+	}
+	return h, scanner.Err()
+}
+
+func (h *Hosts) Add(name string, ip net.IP) {
+	name = normalizeName(name)
+	h.addrs[name] = append(h.addrs[name], ip)
+}
+
+// Lookup returns the addresses of name, false if it is not in the table
+func (h *Hosts) Lookup(name string) ([]net.IP, bool) {
+	ips, ok := h.addrs[normalizeName(name)]
+	return ips, ok
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,132 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// TTL of the answers made from hosts and block rules
+const localTTL = 60
+
+type RuleAction int
+
+const (
+	RULE_FORWARD RuleAction = iota
+	RULE_BLOCK_NXDOMAIN
+	RULE_BLOCK_ZERO
+)
+
+func (a RuleAction) String() string {
+	switch a {
+	case RULE_FORWARD:
+		return "FORWARD"
+	case RULE_BLOCK_NXDOMAIN:
+		return "BLOCK_NXDOMAIN"
+	case RULE_BLOCK_ZERO:
+		return "BLOCK_ZERO"
+	}
+	return fmt.Sprintf("RuleAction(%d)", int(a))
+}
+
+// Rule matches the queries for a domain in Suffixes or under them, the
+// forwarded queries go to Next
+type Rule struct {
+	Suffixes []string
+	Action   RuleAction
+	Next     Exchanger
+}
+
+// Router answers queries from hosts, then by the first matched rule, the
+// queries not matched go to next
+type Router struct {
+	rules []*Rule
+	hosts *Hosts
+	next  Exchanger
+}
+
+func NewRouter(rules []*Rule, hosts *Hosts, next Exchanger) (*Router, error) {
+	r := &Router{hosts: hosts, next: next}
+	for i, rule := range rules {
+		if rule.Action == RULE_FORWARD && rule.Next == nil {
+			return nil, fmt.Errorf("dns rule %d: no resolver", i)
+		}
+		nrule := &Rule{Action: rule.Action, Next: rule.Next}
+		for _, suffix := range rule.Suffixes {
+			nrule.Suffixes = append(nrule.Suffixes, normalizeName(suffix))
+		}
+		r.rules = append(r.rules, nrule)
+	}
+	return r, nil
+}
+
+// match returns the rule of name, nil if none matched
+func (r *Router) match(name string) *Rule {
+	name = normalizeName(name)
+	for _, rule := range r.rules {
+		for _, suffix := range rule.Suffixes {
+			if name == suffix || suffix == "" || strings.HasSuffix(name, "."+suffix) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Router) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return r.next.Exchange(ctx, msg)
+	}
+	q := msg.Question[0]
+
+	if r.hosts != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		if ips, ok := r.hosts.Lookup(q.Name); ok {
+			return addrAnswer(msg, ips), nil
+		}
+	}
+
+	rule := r.match(q.Name)
+	if rule == nil {
+		return r.next.Exchange(ctx, msg)
+	}
+	switch rule.Action {
+	case RULE_BLOCK_NXDOMAIN:
+		glog.V(1).Infof("dns query %s blocked", q.Name)
+		return new(dns.Msg).SetRcode(msg, dns.RcodeNameError), nil
+	case RULE_BLOCK_ZERO:
+		glog.V(1).Infof("dns query %s blocked", q.Name)
+		return addrAnswer(msg, []net.IP{net.IPv4zero, net.IPv6zero}), nil
+	}
+	return rule.Next.Exchange(ctx, msg)
+}
+
+func (r *Router) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
+	resp, err := r.Exchange(context.Background(), msg)
+	if err != nil {
+		dns.HandleFailed(w, msg)
+		return
+	}
+	writeResponse(w, msg, resp)
+}
+
+// addrAnswer answers the A/AAAA query msg with the addresses of its type in
+// ips, other queries get an empty answer; nil ips are skipped
+func addrAnswer(msg *dns.Msg, ips []net.IP) *dns.Msg {
+	resp := new(dns.Msg).SetReply(msg)
+	resp.Authoritative = true
+	q := msg.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: localTTL}
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		} else if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return resp
+}
@@ -0,0 +1,92 @@
+package dnsproxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// newStubResolver answers every A query with 192.168.1.1 over UDP
+func newStubResolver(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		resp := new(dns.Msg).SetReply(msg)
+		rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 192.168.1.1")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})}
+	go ser.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { ser.Shutdown() }
+}
+
+func TestRouter(t *testing.T) {
+	addr, stop := newStubResolver(t)
+	defer stop()
+
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# test\n10.1.1.1 printer.corp.example\n::1 printer.corp.example localhost\n")
+	f.Close()
+	hosts, err := LoadHosts(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, _ := NewForwarder([]Upstream{NewUDPUpstream(addr)}, 0, 0)
+	tunneled := new(fakeExchanger)
+	router, err := NewRouter([]*Rule{
+		{Suffixes: []string{"ads.example"}, Action: RULE_BLOCK_NXDOMAIN},
+		{Suffixes: []string{"track.example."}, Action: RULE_BLOCK_ZERO},
+		{Suffixes: []string{"corp.example"}, Next: local},
+	}, hosts, tunneled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		addr  string
+	}{
+		{"printer.corp.example.", dns.TypeA, dns.RcodeSuccess, "10.1.1.1"},
+		{"PRINTER.corp.example.", dns.TypeAAAA, dns.RcodeSuccess, "::1"},
+		{"wiki.corp.example.", dns.TypeA, dns.RcodeSuccess, "192.168.1.1"},
+		{"x.ads.example.", dns.TypeA, dns.RcodeNameError, ""},
+		{"track.example.", dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{"track.example.", dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{"notcorp.example.", dns.TypeA, dns.RcodeSuccess, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg).SetQuestion(c.name, c.qtype)
+		resp, err := router.Exchange(context.Background(), msg)
+		if err != nil {
+			t.Error(c.name, err)
+			continue
+		}
+		addr := ""
+		if len(resp.Answer) == 1 {
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				addr = rr.A.String()
+			case *dns.AAAA:
+				addr = rr.AAAA.String()
+			}
+		}
+		if resp.Rcode != c.rcode || addr != c.addr {
+			t.Error(c.name, dns.TypeToString[c.qtype], resp.Rcode, addr)
+		}
+	}
+	if tunneled.queries != 1 {
+		t.Error("expect 1 tunneled query, got", tunneled.queries)
+	}
+}
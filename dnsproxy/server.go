@@ -0,0 +1,163 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/breaksocks/breaksocks/tunnel"
+	"github.com/miekg/dns"
+	"io"
+	"strings"
+)
+
+// Server is the DNS server of a client config: the queries are answered by
+// the hosts and rules, then the fake IPs or the tunneled resolvers, through
+// the cache
+type Server struct {
+	cfg     *tunnel.ClientConfig
+	handler dns.Handler
+	cache   *Cache
+	fake_ip *FakeIP
+	// the upstreams with persistent conns
+	closers []io.Closer
+}
+
+// NewServer builds the server of cfg, the tunneled resolvers are dialed with
+// dialer
+func NewServer(cfg *tunnel.ClientConfig, dialer Dialer) (*Server, error) {
+	s := &Server{cfg: cfg}
+	forwarder, err := s.newForwarder(append([]string{cfg.DNSRemoteAddr}, cfg.DNSRemoteAddrs...), dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	var next Exchanger = forwarder
+	if len(cfg.DNSFakeIPRanges) > 0 {
+		if s.fake_ip, err = NewFakeIP(cfg.DNSFakeIPRanges, cfg.DNSFakeIPSize, forwarder); err != nil {
+			return nil, err
+		}
+		next = s.fake_ip
+	}
+	router, err := s.newRouter(forwarder, next, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	s.handler = router
+	if cfg.DNSCacheSize > 0 {
+		s.cache = NewCache(router, cfg.DNSCacheSize, cfg.DNSCacheServeStale, cfg.DNSCachePrefetch)
+		s.handler = s.cache
+	}
+	return s, nil
+}
+
+// Cache returns the cache, nil if disabled
+func (s *Server) Cache() *Cache {
+	return s.cache
+}
+
+// FakeIP returns the fake IP mapping, nil if disabled
+func (s *Server) FakeIP() *FakeIP {
+	return s.fake_ip
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
+	s.handler.ServeDNS(w, msg)
+}
+
+// Serve listens on DNSListenAddr until ctx is done
+func (s *Server) Serve(ctx context.Context) error {
+	lnet := "udp"
+	if s.cfg.DNSListenOnTCP {
+		lnet = "tcp"
+	}
+	ser := &dns.Server{Addr: s.cfg.DNSListenAddr, Net: lnet, Handler: s}
+	go func() {
+		<-ctx.Done()
+		ser.Shutdown()
+	}()
+	err := ser.ListenAndServe()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Close closes the conns to the upstreams
+func (s *Server) Close() error {
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+// newForwarder queries addrs through dialer, or directly if dialer is nil
+func (s *Server) newForwarder(addrs []string, dialer Dialer) (*Forwarder, error) {
+	var upstreams []Upstream
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		up, err := NewUpstream(addr, dialer, s.cfg.DNSStreams)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, up)
+		if closer, ok := up.(io.Closer); ok {
+			s.closers = append(s.closers, closer)
+		}
+	}
+	if s.cfg.DNSRaceUpstreams && len(upstreams) > 1 {
+		upstreams = []Upstream{NewRaceUpstream(upstreams)}
+	}
+	retries := s.cfg.DNSRetries
+	if retries == 0 {
+		retries = 2
+	}
+	return NewForwarder(upstreams, s.cfg.DNSQueryTimeout, retries)
+}
+
+// newRouter builds the DNSRules, the tunnel rules without resolvers use
+// forwarder and the queries not matched go to next
+func (s *Server) newRouter(forwarder *Forwarder, next Exchanger, dialer Dialer) (*Router, error) {
+	var rules []*Rule
+	for i, rc := range s.cfg.DNSRules {
+		rule := &Rule{Suffixes: rc.DomainSuffix, Next: forwarder}
+		var err error
+		switch strings.ToLower(rc.Action) {
+		case "", "tunnel", "proxy":
+			if len(rc.Resolvers) > 0 {
+				rule.Next, err = s.newForwarder(rc.Resolvers, dialer)
+			}
+		case "direct":
+			if len(rc.Resolvers) == 0 {
+				err = fmt.Errorf("no resolver")
+			} else {
+				rule.Next, err = s.newForwarder(rc.Resolvers, nil)
+			}
+		case "block", "reject":
+			switch strings.ToLower(rc.BlockWith) {
+			case "", "nxdomain":
+				rule.Action = RULE_BLOCK_NXDOMAIN
+			case "zero":
+				rule.Action = RULE_BLOCK_ZERO
+			default:
+				err = fmt.Errorf("no such block answer: %s", rc.BlockWith)
+			}
+		default:
+			err = fmt.Errorf("no such action: %s", rc.Action)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dns rule %d: %v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	var hosts *Hosts
+	if s.cfg.DNSHostsFile != "" {
+		var err error
+		if hosts, err = LoadHosts(s.cfg.DNSHostsFile); err != nil {
+			return nil, err
+		}
+	}
+	return NewRouter(rules, hosts, next)
+}
@@ -0,0 +1,316 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errStreamClosed = errors.New("dnsproxy: stream closed")
+var errStreamBusy = errors.New("dnsproxy: too many pending queries")
+
+// Dialer opens the conns to the upstream resolvers, tunnel.Client
+// implements it
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Upstream exchanges queries with a resolver
+type Upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// NewUpstream makes the upstream of a resolver address: "host:port" or
+// "tcp://host:port" for DNS over TCP, "tls://host[:port]" for DNS over TLS
+// and "https://host/path" for DNS over HTTPS. A nil dialer connects directly
+// and queries "host:port" over UDP.
+func NewUpstream(addr string, dialer Dialer, n_streams int) (Upstream, error) {
+	scheme, host := "", addr
+	if idx := strings.Index(addr, "://"); idx >= 0 {
+		scheme, host = strings.ToLower(addr[:idx]), addr[idx+3:]
+	}
+	if dialer == nil {
+		if scheme == "" {
+			return NewUDPUpstream(addr), nil
+		}
+		dialer = new(net.Dialer)
+	}
+
+	switch scheme {
+	case "", "tcp":
+		return NewTCPUpstream(host, dialer, n_streams), nil
+	case "tls":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "853")
+		}
+		return NewTLSUpstream(host, dialer, n_streams, nil), nil
+	case "https":
+		return NewHTTPSUpstream(addr, dialer, nil), nil
+	}
+	return nil, fmt.Errorf("dnsproxy: unsupported resolver %s", addr)
+}
+
+// TCPUpstream sends queries over a pool of persistent DNS over TCP streams,
+// the queries on a stream are pipelined and matched by ID
+type TCPUpstream struct {
+	scheme string
+	addr   string
+	dialer Dialer
+
+	lock  sync.Mutex
+	slots []*streamSlot
+	next  int
+}
+
+// streamSlot is held while dialing, so a slot has one stream
+type streamSlot struct {
+	lock   sync.Mutex
+	stream *dnsStream
+}
+
+func NewTCPUpstream(addr string, dialer Dialer, n_streams int) *TCPUpstream {
+	if n_streams <= 0 {
+		n_streams = 1
+	}
+	u := &TCPUpstream{scheme: "tcp", addr: addr, dialer: dialer}
+	for i := 0; i < n_streams; i++ {
+		u.slots = append(u.slots, new(streamSlot))
+	}
+	return u
+}
+
+func (u *TCPUpstream) String() string {
+	return u.scheme + "://" + u.addr
+}
+
+func (u *TCPUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	s, err := u.stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.exchange(ctx, msg)
+}
+
+// Close closes the streams, the following queries open new ones
+func (u *TCPUpstream) Close() error {
+	for _, slot := range u.slots {
+		slot.lock.Lock()
+		if slot.stream != nil {
+			slot.stream.close()
+			slot.stream = nil
+		}
+		slot.lock.Unlock()
+	}
+	return nil
+}
+
+// stream returns the streams in turn, the closed ones are dialed again
+func (u *TCPUpstream) stream(ctx context.Context) (*dnsStream, error) {
+	u.lock.Lock()
+	slot := u.slots[u.next]
+	u.next = (u.next + 1) % len(u.slots)
+	u.lock.Unlock()
+
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	if slot.stream != nil && !slot.stream.isClosed() {
+		return slot.stream, nil
+	}
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	slot.stream = newDNSStream(conn)
+	return slot.stream, nil
+}
+
+type dnsStream struct {
+	conn  *dns.Conn
+	wlock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	next_id uint16
+	closed  bool
+	done    chan struct{}
+}
+
+func newDNSStream(conn net.Conn) *dnsStream {
+	s := &dnsStream{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{})}
+	go s.readLoop()
+	return s
+}
+
+func (s *dnsStream) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *dnsStream) close() {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		s.conn.Close()
+	}
+	s.lock.Unlock()
+}
+
+func (s *dnsStream) readLoop() {
+	defer s.close()
+	for {
+		resp, err := s.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		ch, ok := s.pending[resp.Id]
+		s.lock.Unlock()
+		if ok {
+			select {
+			case ch <- resp:
+			default:
+			}
+		}
+	}
+}
+
+// exchange sends msg with an ID unique on the stream, the response gets the
+// ID of msg back
+func (s *dnsStream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, errStreamClosed
+	} else if len(s.pending) >= 0xFFFF {
+		s.lock.Unlock()
+		return nil, errStreamBusy
+	}
+	for {
+		s.next_id++
+		if _, ok := s.pending[s.next_id]; !ok {
+			break
+		}
+	}
+	id := s.next_id
+	s.pending[id] = ch
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, id)
+		s.lock.Unlock()
+	}()
+
+	query := msg.Copy()
+	query.Id = id
+	s.wlock.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	} else {
+		s.conn.SetWriteDeadline(time.Time{})
+	}
+	err := s.conn.WriteMsg(query)
+	s.wlock.Unlock()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		resp.Id = msg.Id
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, errStreamClosed
+	}
+}
+
+// UDPUpstream queries a resolver directly over UDP, truncated responses are
+// queried again over TCP
+type UDPUpstream struct {
+	addr string
+}
+
+func NewUDPUpstream(addr string) *UDPUpstream {
+	return &UDPUpstream{addr: addr}
+}
+
+func (u *UDPUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+func (u *UDPUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	cli := &dns.Client{Net: "udp", UDPSize: dns.DefaultMsgSize}
+	resp, _, err := cli.ExchangeContext(ctx, msg, u.addr)
+	if err == nil && resp.Truncated {
+		cli.Net = "tcp"
+		resp, _, err = cli.ExchangeContext(ctx, msg, u.addr)
+	}
+	return resp, err
+}
+
+// RaceUpstream sends each query to all upstreams at once, the first answer
+// wins. A SERVFAIL is only returned if no upstream answers better.
+type RaceUpstream struct {
+	upstreams []Upstream
+}
+
+func NewRaceUpstream(upstreams []Upstream) *RaceUpstream {
+	return &RaceUpstream{upstreams: upstreams}
+}
+
+func (u *RaceUpstream) String() string {
+	names := make([]string, len(u.upstreams))
+	for i, up := range u.upstreams {
+		names[i] = up.String()
+	}
+	return "race(" + strings.Join(names, ", ") + ")"
+}
+
+func (u *RaceUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	res_ch := make(chan result, len(u.upstreams))
+	for _, up := range u.upstreams {
+		go func(up Upstream) {
+			resp, err := up.Exchange(ctx, msg)
+			res_ch <- result{resp, err}
+		}(up)
+	}
+
+	var servfail *dns.Msg
+	var last_err error
+	for range u.upstreams {
+		res := <-res_ch
+		if res.err != nil {
+			last_err = res.err
+		} else if res.resp.Rcode == dns.RcodeServerFailure {
+			servfail = res.resp
+		} else {
+			return res.resp, nil
+		}
+	}
+	if servfail != nil {
+		return servfail, nil
+	}
+	return nil, last_err
+}
@@ -0,0 +1,96 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countDialer struct {
+	dials int32
+}
+
+func (d *countDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return new(net.Dialer).DialContext(ctx, network, address)
+}
+
+// newTestResolver answers A queries of "<n>.test." with 10.0.0.<n> after n
+// milliseconds, so the answers of a stream come out of order
+func newTestResolver(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		var n int
+		fmt.Sscanf(msg.Question[0].Name, "%d.test.", &n)
+		time.Sleep(time.Duration(n) * time.Millisecond)
+		resp := new(dns.Msg).SetReply(msg)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.0.%d", msg.Question[0].Name, n))
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})}
+	go ser.ActivateAndServe()
+	return l.Addr().String(), func() { ser.Shutdown() }
+}
+
+func TestTCPUpstreamPipeline(t *testing.T) {
+	addr, stop := newTestResolver(t)
+	defer stop()
+	dialer := new(countDialer)
+	up := NewTCPUpstream(addr, dialer, 1)
+	defer up.Close()
+
+	var wg sync.WaitGroup
+	for i := 20; i > 0; i-- {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			msg := new(dns.Msg).SetQuestion(fmt.Sprintf("%d.test.", n), dns.TypeA)
+			msg.Id = 1000
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			resp, err := up.Exchange(ctx, msg)
+			if err != nil {
+				t.Error(n, err)
+				return
+			}
+			if resp.Id != 1000 || len(resp.Answer) != 1 ||
+				resp.Answer[0].(*dns.A).A.String() != fmt.Sprintf("10.0.0.%d", n) {
+				t.Error(n, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&dialer.dials); n != 1 {
+		t.Error("expect 1 stream, got", n)
+	}
+}
+
+func TestForwarderRetry(t *testing.T) {
+	addr, stop := newTestResolver(t)
+	defer stop()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+
+	dialer := new(countDialer)
+	f, err := NewForwarder([]Upstream{
+		NewTCPUpstream(dead, dialer, 1),
+		NewTCPUpstream(addr, dialer, 1)}, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg).SetQuestion("1.test.", dns.TypeA)
+	if resp, err := f.Exchange(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Answer) != 1 {
+		t.Error("answer", resp)
+	}
+}
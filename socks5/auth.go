@@ -1,18 +1,162 @@
 package socks5
 
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	SocksMethodNoAuth     = 0
+	SocksMethodUserPasswd = 2
+)
+
 type SocksAuth interface {
 	Check(user, passwd string) bool
 }
 
+// SocksAuthMethod is an auth method of the SOCKS5 negotiation, other methods
+// or checks can be plugged in by implementing it
+type SocksAuthMethod interface {
+	// Method returns the METHOD code
+	Method() byte
+	// Accept reports whether a client from addr may use the method
+	Accept(addr net.Addr) bool
+	// Authenticate runs the sub-negotiation after the method is selected, it
+	// returns the authenticated user, empty for anonymous
+	Authenticate(conn net.Conn) (string, bool)
+}
+
 type SimpleAuth map[string]string
 
 func NewSimpleAuth() SimpleAuth {
 	return make(SimpleAuth)
 }
 
+// LoadSimpleAuth loads a file of "user:password" lines
+func LoadSimpleAuth(path string) (SimpleAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	auth := NewSimpleAuth()
+	scanner := bufio.NewScanner(f)
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("%s:%d: expect user:password", path, line_no)
+		}
+		auth[line[:idx]] = line[idx+1:]
+	}
+	return auth, scanner.Err()
+}
+
 func (s SimpleAuth) Check(user, passwd string) bool {
 	if real_pwd, ok := s[user]; ok {
 		return real_pwd == passwd
 	}
 	return false
 }
+
+// NoAuth allows clients from the given networks without auth
+type NoAuth struct {
+	nets []*net.IPNet
+}
+
+// NewNoAuth allows the clients in cidrs, all clients if cidrs is empty
+func NewNoAuth(cidrs []string) (*NoAuth, error) {
+	a := new(NoAuth)
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.nets = append(a.nets, ipnet)
+	}
+	return a, nil
+}
+
+func (a *NoAuth) Method() byte {
+	return SocksMethodNoAuth
+}
+
+func (a *NoAuth) Accept(addr net.Addr) bool {
+	if len(a.nets) == 0 {
+		return true
+	}
+	tcp_addr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range a.nets {
+		if ipnet.Contains(tcp_addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *NoAuth) Authenticate(conn net.Conn) (string, bool) {
+	return "", true
+}
+
+// UserPasswdAuth is the username/password method of RFC 1929
+type UserPasswdAuth struct {
+	auth SocksAuth
+}
+
+func NewUserPasswdAuth(auth SocksAuth) *UserPasswdAuth {
+	return &UserPasswdAuth{auth: auth}
+}
+
+func (a *UserPasswdAuth) Method() byte {
+	return SocksMethodUserPasswd
+}
+
+func (a *UserPasswdAuth) Accept(addr net.Addr) bool {
+	return true
+}
+
+func (a *UserPasswdAuth) Authenticate(conn net.Conn) (string, bool) {
+	/*
+	   +----+------+----------+------+----------+
+	   |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	   +----+------+----------+------+----------+
+	   | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	   +----+------+----------+------+----------+
+	*/
+	var buf [513]byte
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", false
+	} else if buf[0] != 1 || buf[1] == 0 {
+		return "", false
+	}
+	idx := 2 + int(buf[1])
+	if _, err := io.ReadFull(conn, buf[2:idx+1]); err != nil || buf[idx] == 0 {
+		return "", false
+	}
+	user := string(buf[2:idx])
+	end := idx + 1 + int(buf[idx])
+	if _, err := io.ReadFull(conn, buf[idx+1:end]); err != nil {
+		return "", false
+	}
+	passwd := string(buf[idx+1 : end])
+
+	auth_ok := a.auth.Check(user, passwd)
+	if auth_ok {
+		conn.Write(SocksUPAuthSuccess)
+	} else {
+		conn.Write(SocksUPAuthFail)
+	}
+	return user, auth_ok
+}
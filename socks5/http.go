@@ -0,0 +1,329 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hop-by-hop headers, they are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPProxyServer is a HTTP proxy over a SocksTunnel, it supports CONNECT
+// and plain http requests with absolute URI
+type HTTPProxyServer struct {
+	*connListener
+	tunnel  SocksTunnel
+	methods []SocksAuthMethod
+}
+
+// NewHTTPProxyServer requires username/password if auth is not nil,
+// otherwise no auth
+func NewHTTPProxyServer(addr string, t SocksTunnel, auth SocksAuth) (*HTTPProxyServer, error) {
+	var method SocksAuthMethod = &NoAuth{}
+	if auth != nil {
+		method = NewUserPasswdAuth(auth)
+	}
+	return NewHTTPProxyServerWithMethods(addr, t, []SocksAuthMethod{method})
+}
+
+// NewHTTPProxyServerWithMethods takes the auth methods of the socks5
+// server: a client is served if it has the Proxy-Authorization of a
+// UserPasswdAuth or a NoAuth method accepts it
+func NewHTTPProxyServerWithMethods(addr string, t SocksTunnel, methods []SocksAuthMethod) (*HTTPProxyServer, error) {
+	l, err := newConnListener(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPProxyServer{connListener: l, tunnel: t, methods: methods}, nil
+}
+
+func (hs *HTTPProxyServer) Run() {
+	if err := hs.Serve(context.Background()); err != nil && err != ErrServerClosed {
+		glog.Fatalf("accept fail: %v", err)
+	}
+}
+
+// Serve accepts clients until ctx is done or Shutdown is called, it returns
+// ErrServerClosed in both cases
+func (hs *HTTPProxyServer) Serve(ctx context.Context) error {
+	return hs.serve(ctx, hs.handleConn)
+}
+
+// bufferedConn reads the data buffered by the request reader first
+type bufferedConn struct {
+	conn *net.TCPConn
+	r    *bufio.Reader
+}
+
+func (c *bufferedConn) Read(bs []byte) (int, error) {
+	return c.r.Read(bs)
+}
+
+func (c *bufferedConn) Write(bs []byte) (int, error) {
+	return c.conn.Write(bs)
+}
+
+func (c *bufferedConn) Close() error {
+	return c.conn.Close()
+}
+
+// httpUpstream is the tunnel conn of the last forwarded request, it is
+// reused by the following requests to the same host
+type httpUpstream struct {
+	addr string
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (hs *HTTPProxyServer) handleConn(conn *net.TCPConn) {
+	defer conn.Close()
+
+	var up *httpUpstream
+	defer func() {
+		if up != nil {
+			up.conn.Close()
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			if err != io.EOF {
+				glog.V(1).Infof("read http request from %v fail: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		user, ok := hs.checkAuth(conn.RemoteAddr(), req)
+		if !ok {
+			io.Copy(ioutil.Discard, req.Body)
+			writeStatus(conn, http.StatusProxyAuthRequired, req.Close, http.Header{
+				"Proxy-Authenticate": {`Basic realm="breaksocks"`}})
+			if req.Close {
+				return
+			}
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			hs.connect(conn, r, req, user)
+			return
+		}
+		keep_alive, err := hs.forward(conn, &up, req, user)
+		if err != nil {
+			glog.V(1).Infof("forward %s fail: %v", req.URL, err)
+		}
+		if !keep_alive {
+			return
+		}
+	}
+}
+
+// checkAuth returns the user of the Proxy-Authorization, empty for a
+// client allowed without auth
+func (hs *HTTPProxyServer) checkAuth(addr net.Addr, req *http.Request) (string, bool) {
+	user, passwd, has_auth := proxyBasicAuth(req)
+	if has_auth {
+		for _, method := range hs.methods {
+			if up, ok := method.(*UserPasswdAuth); ok && up.Accept(addr) && up.auth.Check(user, passwd) {
+				return user, true
+			}
+		}
+	}
+	for _, method := range hs.methods {
+		if method.Method() == SocksMethodNoAuth && method.Accept(addr) {
+			return "", true
+		}
+	}
+	if has_auth {
+		glog.V(1).Infof("auth %v(%s) fail", addr, user)
+	}
+	return "", false
+}
+
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if len(auth) < 6 || !strings.EqualFold(auth[:6], "Basic ") {
+		return "", "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+	if err != nil {
+		return "", "", false
+	}
+	idx := strings.IndexByte(string(data), ':')
+	if idx < 0 {
+		return "", "", false
+	}
+	return string(data[:idx]), string(data[idx+1:]), true
+}
+
+// connect replies after the remote conn is made if the tunnel is a
+// SocksDialer, otherwise it replies 200 first
+func (hs *HTTPProxyServer) connect(conn *net.TCPConn, r *bufio.Reader, req *http.Request, user string) {
+	host, port, err := splitHostPort(req.Host, 443)
+	if err != nil {
+		writeStatus(conn, http.StatusBadRequest, true, nil)
+		return
+	}
+	const established = "HTTP/1.1 200 Connection Established\r\n\r\n"
+	rconn, ok, err := tunnelDial(hs.tunnel, user, host, port)
+	if !ok {
+		if _, err := io.WriteString(conn, established); err == nil {
+			hs.doProxy(host, port, &bufferedConn{conn, r})
+		}
+		return
+	}
+	if err != nil {
+		glog.V(1).Infof("connect %s:%d fail: %v", host, port, err)
+		writeStatus(conn, httpStatusCode(err), true, nil)
+		return
+	}
+	defer rconn.Close()
+	if _, err := io.WriteString(conn, established); err != nil {
+		return
+	}
+	pipeConn(&bufferedConn{conn, r}, rconn)
+}
+
+// httpStatusCode maps a dial error to 504 for timeouts and 502 otherwise
+func httpStatusCode(err error) int {
+	if socksReplyCode(err) == SocksRepTTLExpired {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// forward sends req to its host and writes the response to conn, *up is the
+// upstream kept for the next request. It returns false if conn should be
+// closed.
+func (hs *HTTPProxyServer) forward(conn *net.TCPConn, up **httpUpstream, req *http.Request, user string) (bool, error) {
+	drop_up := func() {
+		if *up != nil {
+			(*up).conn.Close()
+			*up = nil
+		}
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeStatus(conn, http.StatusBadRequest, true, nil)
+		return false, nil
+	}
+	host, port, err := splitHostPort(req.URL.Host, 80)
+	if err != nil {
+		writeStatus(conn, http.StatusBadRequest, true, nil)
+		return false, nil
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if *up != nil && (*up).addr != addr {
+		drop_up()
+	}
+	if *up == nil {
+		rconn, ok, err := tunnelDial(hs.tunnel, user, host, port)
+		if !ok {
+			local, remote := net.Pipe()
+			go hs.doProxy(host, port, remote)
+			rconn = local
+		} else if err != nil {
+			writeStatus(conn, httpStatusCode(err), true, nil)
+			return false, err
+		}
+		*up = &httpUpstream{addr: addr, conn: rconn, r: bufio.NewReader(rconn)}
+	}
+
+	removeHopHeaders(req.Header)
+	req.RequestURI = ""
+	if err := req.Write((*up).conn); err != nil {
+		drop_up()
+		writeStatus(conn, http.StatusBadGateway, true, nil)
+		return false, err
+	}
+	resp, err := http.ReadResponse((*up).r, req)
+	if err != nil {
+		drop_up()
+		writeStatus(conn, http.StatusBadGateway, true, nil)
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Close {
+		defer drop_up()
+	}
+	keep_alive := !req.Close && !resp.Close && (resp.ContentLength >= 0 ||
+		len(resp.TransferEncoding) > 0 || req.Method == http.MethodHead)
+	removeHopHeaders(resp.Header)
+	resp.Close = !keep_alive
+	if err := resp.Write(conn); err != nil {
+		drop_up()
+		return false, err
+	}
+	return keep_alive, nil
+}
+
+func (hs *HTTPProxyServer) doProxy(host string, port int, rw io.ReadWriteCloser) {
+	if ip := net.ParseIP(host); ip == nil {
+		hs.tunnel.DoDomainProxy(host, port, rw)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		hs.tunnel.DoIPProxy(ip4, port, rw)
+	} else {
+		hs.tunnel.DoIPProxy(ip, port, rw)
+	}
+}
+
+func splitHostPort(hostport string, default_port int) (string, int, error) {
+	host, port_s, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// no port
+		host, port_s = strings.Trim(hostport, "[]"), strconv.Itoa(default_port)
+	}
+	port, err := strconv.Atoi(port_s)
+	if err != nil || port <= 0 || port > 65535 || host == "" || len(host) > 255 {
+		return "", 0, &net.AddrError{Err: "invalid address", Addr: hostport}
+	}
+	return host, port, nil
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, field := range header["Connection"] {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func writeStatus(conn net.Conn, code int, close bool, header http.Header) error {
+	if header == nil {
+		header = make(http.Header)
+	}
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      close}
+	return resp.Write(conn)
+}
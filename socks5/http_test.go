@@ -0,0 +1,248 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// directTunnel connects the destinations directly
+type directTunnel struct {
+	dials int32
+}
+
+func (t *directTunnel) DoDomainProxy(domain string, port int, rw io.ReadWriteCloser) {
+	t.proxy(net.JoinHostPort(domain, strconv.Itoa(port)), rw)
+}
+
+func (t *directTunnel) DoIPProxy(addr []byte, port int, rw io.ReadWriteCloser) {
+	t.proxy(net.JoinHostPort(net.IP(addr).String(), strconv.Itoa(port)), rw)
+}
+
+func (t *directTunnel) proxy(addr string, rw io.ReadWriteCloser) {
+	defer rw.Close()
+	atomic.AddInt32(&t.dials, 1)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	exit_ch := make(chan bool, 2)
+	go func() {
+		io.Copy(conn, rw)
+		exit_ch <- true
+	}()
+	go func() {
+		io.Copy(rw, conn)
+		exit_ch <- true
+	}()
+	<-exit_ch
+}
+
+func newTestHTTPProxy(t *testing.T, auth SocksAuth) (*HTTPProxyServer, *directTunnel) {
+	tun := new(directTunnel)
+	ser, err := NewHTTPProxyServer("127.0.0.1:0", tun, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	return ser, tun
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+
+	auth := NewSimpleAuth()
+	auth["user"] = "passwd"
+	ser, tun := newTestHTTPProxy(t, auth)
+	defer ser.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ser.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	r := bufio.NewReader(conn)
+
+	url := "http://" + l.Addr().String()
+	req, _ := http.NewRequest("GET", url+"/a", nil)
+	req.Write(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatal("expect 407, got", resp.Status)
+	}
+
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:passwd"))
+	for _, path := range []string{"/b", "/c"} {
+		req, _ := http.NewRequest("GET", url+path, nil)
+		req.Header.Set("Proxy-Authorization", basic)
+		req.WriteProxy(conn)
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "GET "+path {
+			t.Errorf("got %q for %s", body, path)
+		}
+	}
+	if n := atomic.LoadInt32(&tun.dials); n != 1 {
+		t.Error("expect 1 upstream conn, got", n)
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	ser, _ := newTestHTTPProxy(t, nil)
+	defer ser.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ser.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the data after the request must not be lost
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello", l.Addr(), l.Addr())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatal("connect fail:", resp.Status)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("echo %q %v", buf, err)
+	}
+}
+
+func TestHTTPProxyNoAuthCIDR(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	auth := NewSimpleAuth()
+	auth["user"] = "passwd"
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:passwd"))
+	for _, c := range []struct {
+		cidr   string
+		users  bool
+		header string
+		code   int
+	}{
+		{"127.0.0.0/8", false, "", http.StatusOK},
+		{"10.0.0.0/8", false, "", http.StatusProxyAuthRequired},
+		{"10.0.0.0/8", false, basic, http.StatusProxyAuthRequired},
+		{"10.0.0.0/8", true, "", http.StatusProxyAuthRequired},
+		{"10.0.0.0/8", true, basic, http.StatusOK},
+	} {
+		no_auth, err := NewNoAuth([]string{c.cidr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		methods := []SocksAuthMethod{no_auth}
+		if c.users {
+			methods = append(methods, NewUserPasswdAuth(auth))
+		}
+		ser, err := NewHTTPProxyServerWithMethods("127.0.0.1:0", new(directTunnel), methods)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ser.Serve(context.Background())
+
+		conn, err := net.Dial("tcp", ser.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		if c.header != "" {
+			req.Header.Set("Proxy-Authorization", c.header)
+		}
+		req.WriteProxy(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%+v: got %s", c, resp.Status)
+		}
+		conn.Close()
+		ser.Shutdown(context.Background())
+	}
+}
+
+func TestHTTPProxyConnectFail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ser, err := NewHTTPProxyServer("127.0.0.1:0", new(dialTunnel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ser.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("expect 502, got", resp.Status)
+	}
+}
@@ -0,0 +1,123 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("socks5: server closed")
+
+// connListener keeps the accepted conns until they are handled, so
+// Shutdown can wait for or close them
+type connListener struct {
+	listener *net.TCPListener
+
+	lock     sync.Mutex
+	conns    map[*net.TCPConn]bool
+	shutdown bool
+	done     chan struct{}
+}
+
+func newConnListener(addr string) (*connListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &connListener{
+		listener: l.(*net.TCPListener),
+		conns:    make(map[*net.TCPConn]bool),
+		done:     make(chan struct{})}, nil
+}
+
+func (cl *connListener) Addr() net.Addr {
+	return cl.listener.Addr()
+}
+
+// serve runs handle for every accepted conn until ctx is done or Shutdown
+// is called
+func (cl *connListener) serve(ctx context.Context, handle func(*net.TCPConn)) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			cl.listener.Close()
+		case <-cl.done:
+		}
+	}()
+
+	for {
+		conn, err := cl.listener.AcceptTCP()
+		if err != nil {
+			if cl.isShutdown() || ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !cl.addConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer cl.delConn(conn)
+			handle(conn)
+		}()
+	}
+}
+
+func (cl *connListener) isShutdown() bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.shutdown
+}
+
+func (cl *connListener) addConn(conn *net.TCPConn) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.shutdown {
+		return false
+	}
+	cl.conns[conn] = true
+	return true
+}
+
+func (cl *connListener) delConn(conn *net.TCPConn) {
+	cl.lock.Lock()
+	delete(cl.conns, conn)
+	cl.lock.Unlock()
+}
+
+func (cl *connListener) numConns() int {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return len(cl.conns)
+}
+
+// Shutdown stops accepting clients, waits for the running ones to finish
+// until ctx is done, then closes them
+func (cl *connListener) Shutdown(ctx context.Context) error {
+	cl.lock.Lock()
+	if !cl.shutdown {
+		cl.shutdown = true
+		close(cl.done)
+	}
+	cl.lock.Unlock()
+	cl.listener.Close()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for cl.numConns() > 0 {
+		select {
+		case <-ctx.Done():
+			cl.lock.Lock()
+			for conn := range cl.conns {
+				conn.Close()
+			}
+			cl.lock.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"github.com/golang/glog"
+	"io"
+	"net"
+)
+
+const Socks4Version = 4
+
+var (
+	Socks4ReplyGranted  = []byte{0, 90, 0, 0, 0, 0, 0, 0}
+	Socks4ReplyRejected = []byte{0, 91, 0, 0, 0, 0, 0, 0}
+)
+
+// handleSocks4 serves a SOCKS4/4a CONNECT, the VN byte is already read.
+// SOCKS4 has no password, so it is rejected unless no auth is allowed.
+// Like connect it replies after the remote conn is made if the tunnel is a
+// SocksDialer.
+func (ss *Socks5Server) handleSocks4(conn *net.TCPConn) {
+	/*Request:
+	  +----+----+---------+--------+--------+------+-----------+------+
+	  | VN | CD | DSTPORT | DSTIP  | USERID | NULL | DOMAIN(4a)| NULL |
+	  +----+----+---------+--------+--------+------+-----------+------+
+	  | 1  | 1  |    2    |   4    |   *    |  1   |     *     |  1   |
+	  +----+----+---------+--------+--------+------+-----------+------+
+	*/
+	var buf [8]byte
+	if _, err := io.ReadFull(conn, buf[1:8]); err != nil {
+		return
+	}
+	user, err := readNullString(conn, 255)
+	if err != nil {
+		return
+	}
+	if buf[1] != 1 || !ss.allowNoAuth(conn.RemoteAddr()) {
+		glog.V(1).Infof("socks4 request from %v(%s) rejected", conn.RemoteAddr(), user)
+		conn.Write(Socks4ReplyRejected)
+		return
+	}
+
+	port := int(buf[2])*256 + int(buf[3])
+	ip := net.IP(buf[4:8])
+	host := ip.String()
+	// SOCKS4a: 0.0.0.x with x != 0 means a domain follows
+	is_domain := ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+	if is_domain {
+		if host, err = readNullString(conn, 255); err != nil {
+			return
+		} else if host == "" {
+			conn.Write(Socks4ReplyRejected)
+			return
+		}
+	}
+
+	rconn, ok, err := tunnelDial(ss.tunnel, "", host, port)
+	if !ok {
+		conn.Write(Socks4ReplyGranted)
+		if is_domain {
+			ss.tunnel.DoDomainProxy(host, port, conn)
+		} else {
+			ss.tunnel.DoIPProxy(ip, port, conn)
+		}
+		return
+	}
+	if err != nil {
+		glog.V(1).Infof("connect %s:%d fail: %v", host, port, err)
+		conn.Write(Socks4ReplyRejected)
+		return
+	}
+	defer rconn.Close()
+	if _, err := conn.Write(Socks4ReplyGranted); err != nil {
+		return
+	}
+	pipeConn(conn, rconn)
+}
+
+// readNullString reads a string ends with NULL, at most max bytes
+func readNullString(r io.Reader, max int) (string, error) {
+	var str []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(str), nil
+		}
+		if len(str) == max {
+			return "", io.ErrShortBuffer
+		}
+		str = append(str, b[0])
+	}
+}
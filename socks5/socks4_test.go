@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocks4a(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	ser, err := NewSocks5Server("127.0.0.1:0", new(directTunnel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ser.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	port := l.Addr().(*net.TCPAddr).Port
+	req := []byte{4, 1, byte(port >> 8), byte(port), 0, 0, 0, 1}
+	req = append(req, "user\x00localhost\x00"...)
+	conn.Write(req)
+
+	rep := make([]byte, 8)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		t.Fatal(err)
+	} else if rep[0] != 0 || rep[1] != 90 {
+		t.Fatal("socks4 reply", rep)
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, rep[:5]); err != nil || string(rep[:5]) != "hello" {
+		t.Errorf("echo %q %v", rep[:5], err)
+	}
+}
+
+func TestSocks4ConnectFail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	ser, err := NewSocks5Server("127.0.0.1:0", new(dialTunnel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ser.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	conn.Write(append([]byte{4, 1, byte(port >> 8), byte(port), 127, 0, 0, 1}, "user\x00"...))
+	rep := make([]byte, 8)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		t.Fatal(err)
+	} else if rep[1] != 91 {
+		t.Error("expect rejected, got", rep)
+	}
+}
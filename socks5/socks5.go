@@ -1,59 +1,95 @@
 package socks5
 
 import (
+	"bytes"
+	"context"
 	"github.com/golang/glog"
 	"io"
 	"net"
+	"os"
+	"syscall"
 )
 
 const SocksVersion = 5
 const SocksUPCheckVersion = 1
 
 var (
-	SocksAuthNotRequired         = []byte{SocksVersion, 0}
-	SocksAuthUserPasswd          = []byte{SocksVersion, 2}
-	SocksAuthMethodNotMatch      = []byte{SocksVersion, 0xFF}
-	SocksUPAuthSuccess           = []byte{SocksUPCheckVersion, 0}
-	SocksUPAuthFail              = []byte{SocksUPCheckVersion, 1}
-	SocksReplySuccess            = []byte{SocksVersion, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyServerFail         = []byte{SocksVersion, 1, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyNotAllowed         = []byte{SocksVersion, 2, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyNetworkUnreachable = []byte{SocksVersion, 3, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyHostUnreachable    = []byte{SocksVersion, 4, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyRefused            = []byte{SocksVersion, 5, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyTTLExpired         = []byte{SocksVersion, 6, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyInvalidCommand     = []byte{SocksVersion, 7, 0, 1, 0, 0, 0, 0, 0, 0}
-	SocksReplyInvalidAddrType    = []byte{SocksVersion, 8, 0, 1, 0, 0, 0, 0, 0, 0}
+	SocksAuthNotRequired    = []byte{SocksVersion, 0}
+	SocksAuthUserPasswd     = []byte{SocksVersion, 2}
+	SocksAuthMethodNotMatch = []byte{SocksVersion, 0xFF}
+	SocksUPAuthSuccess      = []byte{SocksUPCheckVersion, 0}
+	SocksUPAuthFail         = []byte{SocksUPCheckVersion, 1}
+)
+
+// REP field of replies
+const (
+	SocksRepSuccess            = 0
+	SocksRepServerFail         = 1
+	SocksRepNotAllowed         = 2
+	SocksRepNetworkUnreachable = 3
+	SocksRepHostUnreachable    = 4
+	SocksRepRefused            = 5
+	SocksRepTTLExpired         = 6
+	SocksRepInvalidCommand     = 7
+	SocksRepInvalidAddrType    = 8
 )
 
 type Socks5Server struct {
-	tunnel   SocksTunnel
-	auth     SocksAuth
-	listener *net.TCPListener
+	*connListener
+	tunnel SocksTunnel
+	// in the order of preference
+	methods []SocksAuthMethod
 }
 
+// NewSocks5Server requires username/password if auth is not nil, otherwise
+// no auth
 func NewSocks5Server(addr string, t SocksTunnel, auth SocksAuth) (*Socks5Server, error) {
-	l, err := net.Listen("tcp", addr)
+	var method SocksAuthMethod = &NoAuth{}
+	if auth != nil {
+		method = NewUserPasswdAuth(auth)
+	}
+	return NewSocks5ServerWithMethods(addr, t, []SocksAuthMethod{method})
+}
+
+// NewSocks5ServerWithMethods selects the first of methods that is offered by
+// and accepts the client
+func NewSocks5ServerWithMethods(addr string, t SocksTunnel, methods []SocksAuthMethod) (*Socks5Server, error) {
+	l, err := newConnListener(addr)
 	if err != nil {
 		return nil, err
 	}
-	return &Socks5Server{tunnel: t, auth: auth,
-		listener: l.(*net.TCPListener)}, nil
+	return &Socks5Server{connListener: l, tunnel: t, methods: methods}, nil
 }
 
 func (ss *Socks5Server) Run() {
-	for {
-		if conn, err := ss.listener.AcceptTCP(); err == nil {
-			go ss.handleRequest(conn)
-		} else {
-			glog.Fatalf("accept fail: %v", err)
-		}
+	if err := ss.Serve(context.Background()); err != nil && err != ErrServerClosed {
+		glog.Fatalf("accept fail: %v", err)
 	}
 }
 
+// Serve accepts clients until ctx is done or Shutdown is called, it returns
+// ErrServerClosed in both cases
+func (ss *Socks5Server) Serve(ctx context.Context) error {
+	return ss.serve(ctx, ss.handleRequest)
+}
+
 func (ss *Socks5Server) handleRequest(conn *net.TCPConn) {
 	defer conn.Close()
-	if !ss.authenticate(conn) {
+
+	var ver [1]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return
+	}
+	switch ver[0] {
+	case Socks4Version:
+		ss.handleSocks4(conn)
+		return
+	case SocksVersion:
+	default:
+		return
+	}
+	user, ok := ss.authenticate(conn)
+	if !ok {
 		return
 	}
 
@@ -70,41 +106,133 @@ func (ss *Socks5Server) handleRequest(conn *net.TCPConn) {
 	} else if buf[0] != 5 {
 		return
 	} else if buf[1] != 1 {
-		conn.Write(SocksReplyInvalidCommand)
+		conn.Write(socksReply(SocksRepInvalidCommand, nil))
 		return
 	}
 
+	var domain string
+	var ip net.IP
+	var port int
 	switch buf[3] {
 	case 1:
-		if _, err := io.ReadFull(conn, buf[4:10]); err == nil {
-			port := int(buf[8])*256 + int(buf[9])
-			conn.Write(SocksReplySuccess)
-			ss.tunnel.DoIPProxy(buf[4:8], port, conn)
+		if _, err := io.ReadFull(conn, buf[4:10]); err != nil {
+			return
 		}
+		ip, port = net.IP(buf[4:8]), int(buf[8])*256+int(buf[9])
 	case 3:
 		if _, err := io.ReadFull(conn, buf[4:5]); err != nil {
 			return
-		} else if buf[4] == 0 {
-			conn.Write(SocksReplyHostUnreachable)
+		}
+		n := int(buf[4])
+		if n == 0 {
+			conn.Write(socksReply(SocksRepHostUnreachable, nil))
 			return
-		} else if _, err = io.ReadFull(conn, buf[5:7+buf[4]]); err != nil {
+		} else if _, err := io.ReadFull(conn, buf[5:7+n]); err != nil {
 			return
 		}
-		conn.Write(SocksReplySuccess)
-		port := int(buf[5+buf[4]])*256 + int(buf[6+buf[4]])
-		ss.tunnel.DoDomainProxy(string(buf[5:5+buf[4]]), port, conn)
+		domain = string(buf[5 : 5+n])
+		port = int(buf[5+n])*256 + int(buf[6+n])
 	case 4:
-		if _, err := io.ReadFull(conn, buf[4:22]); err == nil {
-			port := int(buf[20])*256 + int(buf[21])
-			conn.Write(SocksReplySuccess)
-			ss.tunnel.DoIPProxy(buf[4:20], port, conn)
+		if _, err := io.ReadFull(conn, buf[4:22]); err != nil {
+			return
 		}
+		ip, port = net.IP(buf[4:20]), int(buf[20])*256+int(buf[21])
 	default:
-		conn.Write(SocksReplyInvalidAddrType)
+		conn.Write(socksReply(SocksRepInvalidAddrType, nil))
+		return
+	}
+	ss.connect(conn, user, domain, ip, port)
+}
+
+// connect replies after the remote conn is made if the tunnel is a
+// SocksDialer, otherwise it replies success first
+func (ss *Socks5Server) connect(conn *net.TCPConn, user, domain string, ip net.IP, port int) {
+	// the failure replies keep the address type of an IPv6 request
+	var fail_addr net.Addr
+	if ip != nil && ip.To4() == nil {
+		fail_addr = &net.TCPAddr{IP: net.IPv6zero}
+	}
+
+	host := domain
+	if ip != nil {
+		host = ip.String()
+	}
+	rconn, ok, err := tunnelDial(ss.tunnel, user, host, port)
+	if !ok {
+		conn.Write(socksReply(SocksRepSuccess, fail_addr))
+		if ip != nil {
+			ss.tunnel.DoIPProxy(ip, port, conn)
+		} else {
+			ss.tunnel.DoDomainProxy(domain, port, conn)
+		}
+		return
+	}
+	if err != nil {
+		glog.V(1).Infof("connect %s:%d fail: %v", host, port, err)
+		conn.Write(socksReply(socksReplyCode(err), fail_addr))
+		return
+	}
+	defer rconn.Close()
+	if _, err := conn.Write(socksReply(SocksRepSuccess, rconn.LocalAddr())); err != nil {
+		return
 	}
+	pipeConn(conn, rconn)
 }
 
-func (ss *Socks5Server) authenticate(conn *net.TCPConn) bool {
+// socksReply builds a reply with bnd as BND.ADDR/BND.PORT, it is 0.0.0.0:0
+// if bnd is not a TCP address
+func socksReply(rep byte, bnd net.Addr) []byte {
+	ip, port := net.IP(net.IPv4zero), 0
+	if addr, ok := bnd.(*net.TCPAddr); ok && addr.IP != nil {
+		ip, port = addr.IP, addr.Port
+	}
+
+	/*Reply:
+	  +----+-----+-------+------+----------+----------+
+	  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	  +----+-----+-------+------+----------+----------+
+	  | 1  |  1  | X'00' |  1   | Variable |    2     |
+	  +----+-----+-------+------+----------+----------+
+	*/
+	reply := []byte{SocksVersion, rep, 0, 1}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, ip4...)
+	} else {
+		reply[3] = 4
+		reply = append(reply, ip.To16()...)
+	}
+	return append(reply, byte(port>>8), byte(port))
+}
+
+// socksReplyCode maps a dial error to REP
+func socksReplyCode(err error) byte {
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	if coder, ok := err.(interface{ SocksReplyCode() byte }); ok {
+		return coder.SocksReplyCode()
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return SocksRepTTLExpired
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return SocksRepHostUnreachable
+	}
+	if serr, ok := err.(*os.SyscallError); ok {
+		switch serr.Err {
+		case syscall.ECONNREFUSED:
+			return SocksRepRefused
+		case syscall.ENETUNREACH:
+			return SocksRepNetworkUnreachable
+		case syscall.EHOSTUNREACH:
+			return SocksRepHostUnreachable
+		}
+	}
+	return SocksRepServerFail
+}
+
+// authenticate returns the authenticated user, empty for anonymous
+func (ss *Socks5Server) authenticate(conn *net.TCPConn) (string, bool) {
 	/*
 		+----+----------+----------+
 		|VER | NMETHODS | METHODS  |
@@ -112,14 +240,16 @@ func (ss *Socks5Server) authenticate(conn *net.TCPConn) bool {
 		| 1  |    1     | 1 to 255 |
 		+----+----------+----------+
 	*/
+	// VER is read by handleRequest
 	var buf [257]byte
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
-		return false
+	if _, err := io.ReadFull(conn, buf[1:2]); err != nil {
+		return "", false
 	} else if buf[1] > 0 {
 		if _, err := io.ReadFull(conn, buf[2:2+buf[1]]); err != nil {
-			return false
+			return "", false
 		}
 	}
+	offered := buf[2 : 2+buf[1]]
 
 	/*
 	   +----+--------+
@@ -128,65 +258,30 @@ func (ss *Socks5Server) authenticate(conn *net.TCPConn) bool {
 	   | 1  |   1    |
 	   +----+--------+
 	*/
-	var method byte = 0
-	auth_rep := SocksAuthNotRequired
-	if ss.auth != nil {
-		method = 2
-		auth_rep = SocksAuthUserPasswd
-	}
-
-	support_method := false
-	for i := 2; i < 2+int(buf[1]); i++ {
-		if buf[i] == method {
-			support_method = true
-			if _, err := conn.Write(auth_rep); err != nil {
-				return false
-			}
-			break
+	for _, method := range ss.methods {
+		if bytes.IndexByte(offered, method.Method()) < 0 || !method.Accept(conn.RemoteAddr()) {
+			continue
 		}
+		if _, err := conn.Write([]byte{SocksVersion, method.Method()}); err != nil {
+			return "", false
+		}
+		user, ok := method.Authenticate(conn)
+		if !ok {
+			glog.V(1).Infof("auth %v(%s) fail", conn.RemoteAddr(), user)
+		}
+		return user, ok
 	}
-	if !support_method {
-		conn.Write(SocksAuthMethodNotMatch)
-		return false
-	}
-
-	return ss.checkUserPasswd(conn)
+	conn.Write(SocksAuthMethodNotMatch)
+	return "", false
 }
 
-func (ss *Socks5Server) checkUserPasswd(conn *net.TCPConn) bool {
-	if ss.auth == nil {
-		return true
-	}
-	/*
-	   +----+------+----------+------+----------+
-	   |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
-	   +----+------+----------+------+----------+
-	   | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
-	   +----+------+----------+------+----------+
-	*/
-	var buf [513]byte
-
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return false
-	} else if buf[0] != 1 || buf[1] == 0 {
-		return false
-	}
-	idx := 2 + buf[1]
-	if _, err := io.ReadFull(conn, buf[2:idx+1]); err != nil || buf[idx] == 0 {
-		return false
-	}
-	user := string(buf[2:idx])
-	if _, err := io.ReadFull(conn, buf[idx+1:idx+1+buf[idx]]); err != nil {
-		return false
-	}
-	passwd := string(buf[idx+1 : idx+1+buf[idx]])
-
-	auth_ok := ss.auth.Check(user, passwd)
-	if auth_ok {
-		conn.Write(SocksUPAuthSuccess)
-	} else {
-		conn.Write(SocksUPAuthFail)
+// allowNoAuth reports whether the client may go without auth, used by
+// SOCKS4 which has no password
+func (ss *Socks5Server) allowNoAuth(addr net.Addr) bool {
+	for _, method := range ss.methods {
+		if method.Method() == SocksMethodNoAuth && method.Accept(addr) {
+			return true
+		}
 	}
-
-	return auth_ok
+	return false
 }
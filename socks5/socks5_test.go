@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTunnel is a directTunnel that reports the connect result
+type dialTunnel struct {
+	directTunnel
+}
+
+func (t *dialTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, network, address)
+}
+
+func socks5Connect(t *testing.T, ser *Socks5Server, req []byte) []byte {
+	conn, err := net.Dial("tcp", ser.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	conn.Write([]byte{5, 1, 0})
+	buf := make([]byte, 22)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(req)
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		t.Fatal(err)
+	}
+	n := 4 + 4 + 2
+	if buf[3] == 4 {
+		n = 4 + 16 + 2
+	}
+	if _, err := io.ReadFull(conn, buf[4:n]); err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestSocks5Reply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	ser, err := NewSocks5Server("127.0.0.1:0", new(dialTunnel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Shutdown(context.Background())
+
+	rep := socks5Connect(t, ser, []byte{5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	if rep[1] != SocksRepSuccess || rep[3] != 1 {
+		t.Fatal("reply", rep)
+	}
+	if !net.IP(rep[4:8]).Equal(net.IPv4(127, 0, 0, 1)) || int(rep[8])*256+int(rep[9]) == 0 {
+		t.Error("bound addr", rep[4:])
+	}
+
+	l.Close()
+	rep = socks5Connect(t, ser, []byte{5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	if rep[1] != SocksRepRefused {
+		t.Error("expect refused, got", rep)
+	}
+
+	req := append([]byte{5, 1, 0, 4}, net.IPv6loopback...)
+	rep = socks5Connect(t, ser, append(req, byte(port>>8), byte(port)))
+	if rep[1] == SocksRepSuccess || rep[3] != 4 {
+		t.Error("expect IPv6 failure, got", rep)
+	}
+}
+
+// addrTunnel refuses every conn and records the addresses dialed
+type addrTunnel struct {
+	directTunnel
+	addrs chan string
+}
+
+func (t *addrTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	t.addrs <- address
+	return nil, errors.New("refused")
+}
+
+func TestSocks5LongDomain(t *testing.T) {
+	tun := &addrTunnel{addrs: make(chan string, 1)}
+	ser, err := NewSocks5Server("127.0.0.1:0", tun, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Shutdown(context.Background())
+
+	domain := strings.Repeat("a", 255)
+	req := append([]byte{5, 1, 0, 3, byte(len(domain))}, domain...)
+	rep := socks5Connect(t, ser, append(req, 0, 80))
+	if rep[1] == SocksRepSuccess {
+		t.Error("expect failure, got", rep)
+	}
+	if addr := <-tun.addrs; addr != domain+":80" {
+		t.Error("dialed", addr)
+	}
+}
+
+func TestSocks5AuthMethods(t *testing.T) {
+	no_auth, err := NewNoAuth([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewSimpleAuth()
+	auth["user"] = "passwd"
+	ser, err := NewSocks5ServerWithMethods("127.0.0.1:0", new(dialTunnel),
+		[]SocksAuthMethod{no_auth, NewUserPasswdAuth(auth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Shutdown(context.Background())
+
+	auth_with := func(methods []byte, user, passwd string) []byte {
+		conn, err := net.Dial("tcp", ser.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+		conn.Write(append([]byte{5, byte(len(methods))}, methods...))
+		rep := make([]byte, 2)
+		if _, err := io.ReadFull(conn, rep); err != nil || rep[1] != SocksMethodUserPasswd {
+			return rep
+		}
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(passwd))), passwd...)
+		conn.Write(req)
+		io.ReadFull(conn, rep)
+		return rep
+	}
+
+	// loopback is not in the no auth network
+	if rep := auth_with([]byte{SocksMethodNoAuth}, "", ""); rep[1] != 0xFF {
+		t.Error("expect no acceptable method, got", rep)
+	}
+	if rep := auth_with([]byte{SocksMethodNoAuth, SocksMethodUserPasswd}, "user", "passwd"); rep[1] != 0 {
+		t.Error("expect auth success, got", rep)
+	}
+	if rep := auth_with([]byte{SocksMethodUserPasswd}, "user", "wrong"); rep[1] == 0 {
+		t.Error("expect auth fail, got", rep)
+	}
+}
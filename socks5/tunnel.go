@@ -1,10 +1,55 @@
 package socks5
 
 import (
+	"context"
 	"io"
+	"net"
+	"strconv"
 )
 
 type SocksTunnel interface {
 	DoDomainProxy(domain string, port int, rw io.ReadWriteCloser)
 	DoIPProxy(addr []byte, port int, rw io.ReadWriteCloser)
 }
+
+// SocksDialer is implemented by tunnels that report the connect result, the
+// server replies with the real result and bound address through it
+type SocksDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// SocksUserDialer is a SocksDialer that dials on behalf of the authenticated
+// local user
+type SocksUserDialer interface {
+	DialContextAs(ctx context.Context, user, network, address string) (net.Conn, error)
+}
+
+// tunnelDial connects host:port through t on behalf of user, ok is false if
+// t is not a SocksDialer and can't report the connect result
+func tunnelDial(t SocksTunnel, user, host string, port int) (conn net.Conn, ok bool, err error) {
+	dialer, ok := t.(SocksDialer)
+	if !ok {
+		return nil, false, nil
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if user_dialer, is_user := dialer.(SocksUserDialer); is_user && user != "" {
+		conn, err = user_dialer.DialContextAs(context.Background(), user, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(context.Background(), "tcp", address)
+	}
+	return conn, true, err
+}
+
+// pipeConn copies between conn and rconn until one side is done
+func pipeConn(conn io.ReadWriter, rconn net.Conn) {
+	exit_ch := make(chan bool, 2)
+	go func() {
+		io.Copy(rconn, conn)
+		exit_ch <- true
+	}()
+	go func() {
+		io.Copy(conn, rconn)
+		exit_ch <- true
+	}()
+	<-exit_ch
+}
@@ -0,0 +1,108 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// from linux/in6.h, not in syscall
+const (
+	IPV6_TRANSPARENT     = 75
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_ORIGDSTADDR     = IPV6_RECVORIGDSTADDR
+)
+
+// setTransparent sets IP_TRANSPARENT, and IP_RECVORIGDSTADDR for UDP, on an
+// IPv4 or IPv6 socket
+func setTransparent(fd int, udp bool) error {
+	v4_err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	v6_err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+	if v4_err != nil && v6_err != nil {
+		return os.NewSyscallError("setsockopt", v4_err)
+	}
+	if udp {
+		if v4_err == nil {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+		if v6_err == nil {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1); err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+	}
+	return nil
+}
+
+// transparentListenConfig makes the TPROXY listeners, the UDP one shares its
+// port with the reply sockets of the flows to the same port
+func transparentListenConfig(udp bool) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var opt_err error
+		if err := c.Control(func(fd uintptr) {
+			if udp {
+				if opt_err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); opt_err != nil {
+					opt_err = os.NewSyscallError("setsockopt", opt_err)
+					return
+				}
+			}
+			opt_err = setTransparent(int(fd), udp)
+		}); err != nil {
+			return err
+		}
+		return opt_err
+	}}
+}
+
+// listenReplyUDP binds a socket to the non local addr for sending replies
+func listenReplyUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var opt_err error
+		if err := c.Control(func(fd uintptr) {
+			if opt_err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); opt_err == nil {
+				opt_err = setTransparent(int(fd), false)
+			}
+		}); err != nil {
+			return err
+		}
+		return opt_err
+	}}
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// parseOrigDst returns the original destination in the control messages of
+// a datagram
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(data) >= 8:
+			// struct sockaddr_in: family[2] port[2] addr[4]
+			return &net.UDPAddr{
+				IP:   net.IPv4(data[4], data[5], data[6], data[7]),
+				Port: int(data[2])<<8 | int(data[3])}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_ORIGDSTADDR && len(data) >= 24:
+			// struct sockaddr_in6: family[2] port[2] flowinfo[4] addr[16]
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, data[8:24])
+			return &net.UDPAddr{IP: ip, Port: int(data[2])<<8 | int(data[3])}, nil
+		}
+	}
+	return nil, errors.New("no original destination")
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package tproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errNotSupported = errors.New("tproxy: only supported on linux")
+
+func transparentListenConfig(udp bool) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return errNotSupported
+	}}
+}
+
+func listenReplyUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errNotSupported
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errNotSupported
+}
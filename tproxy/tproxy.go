@@ -0,0 +1,255 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerClosed = errors.New("tproxy: server closed")
+
+// Dialer connects the proxied TCP conns and UDP flows, tunnel.Client
+// implements it
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Server accepts the TCP conns and UDP datagrams sent to it by iptables
+// TPROXY rules, the original destinations are connected through dialer
+type Server struct {
+	dialer      Dialer
+	udp_timeout time.Duration
+	tcp_l       *net.TCPListener
+	udp_l       *net.UDPConn
+
+	lock   sync.Mutex
+	flows  map[string]*udpFlow
+	closed bool
+	done   chan struct{}
+}
+
+// udpFlow is the datagrams from src to dst, it is closed after idle for
+// udp_timeout
+type udpFlow struct {
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	send chan []byte
+	// unix nano of the last datagram
+	last int64
+}
+
+func NewServer(addr string, dialer Dialer, udp_timeout time.Duration) (*Server, error) {
+	tcp_l, err := transparentListenConfig(false).Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp_l, err := transparentListenConfig(true).ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		tcp_l.Close()
+		return nil, err
+	}
+	return &Server{
+		dialer:      dialer,
+		udp_timeout: udp_timeout,
+		tcp_l:       tcp_l.(*net.TCPListener),
+		udp_l:       udp_l.(*net.UDPConn),
+		flows:       make(map[string]*udpFlow),
+		done:        make(chan struct{})}, nil
+}
+
+// Serve runs until ctx is done or Close is called, it returns
+// ErrServerClosed in both cases
+func (s *Server) Serve(ctx context.Context) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+
+	err_ch := make(chan error, 2)
+	go func() {
+		err_ch <- s.serveTCP()
+	}()
+	go func() {
+		err_ch <- s.serveUDP()
+	}()
+	err := <-err_ch
+	s.Close()
+	<-err_ch
+
+	if err == nil {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.lock.Unlock()
+
+	s.tcp_l.Close()
+	return s.udp_l.Close()
+}
+
+func (s *Server) serveTCP() error {
+	for {
+		conn, err := s.tcp_l.AcceptTCP()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		// the local address of a TPROXY conn is the original destination
+		go s.handleTCP(conn, conn.LocalAddr().String())
+	}
+}
+
+func (s *Server) handleTCP(conn *net.TCPConn, dst string) {
+	defer conn.Close()
+
+	rconn, err := s.dialer.DialContext(context.Background(), "tcp", dst)
+	if err != nil {
+		glog.V(1).Infof("tproxy connect %s fail: %v", dst, err)
+		return
+	}
+	defer rconn.Close()
+	glog.V(1).Infof("tproxy %v -> %s", conn.RemoteAddr(), dst)
+
+	exit_ch := make(chan bool, 2)
+	go func() {
+		io.Copy(rconn, conn)
+		exit_ch <- true
+	}()
+	go func() {
+		io.Copy(conn, rconn)
+		exit_ch <- true
+	}()
+	<-exit_ch
+}
+
+func (s *Server) serveUDP() error {
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := s.udp_l.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		dst, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			glog.V(1).Infof("tproxy udp from %v: %v", src, err)
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		s.handleUDP(src, dst, data)
+	}
+}
+
+func (s *Server) handleUDP(src, dst *net.UDPAddr, data []byte) {
+	key := src.String() + "-" + dst.String()
+	s.lock.Lock()
+	flow, ok := s.flows[key]
+	if !ok {
+		flow = &udpFlow{src: src, dst: dst, send: make(chan []byte, 64)}
+		flow.touch()
+		s.flows[key] = flow
+		go s.runFlow(key, flow)
+	}
+	s.lock.Unlock()
+
+	select {
+	case flow.send <- data:
+	default:
+		glog.V(2).Infof("tproxy udp %s queue full, drop", key)
+	}
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&f.last))
+}
+
+func (s *Server) runFlow(key string, flow *udpFlow) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.flows, key)
+		s.lock.Unlock()
+	}()
+
+	conn, err := s.dialer.DialContext(context.Background(), "udp", flow.dst.String())
+	if err != nil {
+		glog.V(1).Infof("tproxy udp connect %v fail: %v", flow.dst, err)
+		return
+	}
+	defer conn.Close()
+	// replies are sent from the original destination
+	reply, err := listenReplyUDP(flow.dst)
+	if err != nil {
+		glog.Errorf("tproxy udp bind %v fail: %v", flow.dst, err)
+		return
+	}
+	defer reply.Close()
+	glog.V(1).Infof("tproxy udp %v -> %v", flow.src, flow.dst)
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			flow.touch()
+			if _, err := reply.WriteToUDP(buf[:n], flow.src); err != nil {
+				glog.V(1).Infof("tproxy udp reply to %v fail: %v", flow.src, err)
+			}
+		}
+	}()
+
+	timer := time.NewTimer(s.udp_timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-flow.send:
+			flow.touch()
+			if _, err := conn.Write(data); err != nil {
+				glog.V(1).Infof("tproxy udp send to %v fail: %v", flow.dst, err)
+			}
+		case <-timer.C:
+			if idle := flow.idle(); idle < s.udp_timeout {
+				timer.Reset(s.udp_timeout - idle)
+				continue
+			}
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
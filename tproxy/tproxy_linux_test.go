@@ -0,0 +1,220 @@
+package tproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func makeCmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestParseOrigDst(t *testing.T) {
+	sa4 := []byte{syscall.AF_INET, 0, 0x1f, 0x90, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	addr, err := parseOrigDst(makeCmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, sa4))
+	if err != nil {
+		t.Fatal(err)
+	} else if addr.String() != "10.0.0.1:8080" {
+		t.Error("ipv4 orig dst", addr)
+	}
+
+	sa6 := make([]byte, 28)
+	sa6[0], sa6[2], sa6[3] = syscall.AF_INET6, 0, 53
+	copy(sa6[8:], net.ParseIP("2001:db8::1"))
+	oob := append(makeCmsg(syscall.SOL_SOCKET, syscall.SO_TIMESTAMP, make([]byte, 16)),
+		makeCmsg(syscall.SOL_IPV6, IPV6_ORIGDSTADDR, sa6)...)
+	if addr, err = parseOrigDst(oob); err != nil {
+		t.Fatal(err)
+	} else if addr.String() != "[2001:db8::1]:53" {
+		t.Error("ipv6 orig dst", addr)
+	}
+
+	if _, err := parseOrigDst(nil); err == nil {
+		t.Error("expect error without orig dst")
+	}
+}
+
+// echoDialer connects every flow to a local echo server and records the
+// original destinations
+type echoDialer struct {
+	tcp   string
+	udp   string
+	lock  sync.Mutex
+	dials []string
+}
+
+func (d *echoDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.lock.Lock()
+	d.dials = append(d.dials, network+" "+address)
+	d.lock.Unlock()
+	if network == "udp" {
+		return net.Dial("udp", d.udp)
+	}
+	return net.Dial("tcp", d.tcp)
+}
+
+func (d *echoDialer) dialed() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string(nil), d.dials...)
+}
+
+func echoRoundTrip(conn net.Conn, msg string) error {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err == nil && string(buf[:n]) != msg {
+		err = fmt.Errorf("echo %q, want %q", buf[:n], msg)
+	}
+	return err
+}
+
+// TestTProxyNetns runs the server in a new network namespace where
+// 10.99.0.0/24 is routed to lo like the "local 0.0.0.0/0 dev lo" route of a
+// TPROXY setup, so the conns to those addresses reach the transparent
+// listener with their original destination
+func TestTProxyNetns(t *testing.T) {
+	if os.Getenv("TPROXY_NETNS") == "" {
+		if os.Geteuid() != 0 {
+			t.Skip("needs root for a network namespace")
+		}
+		if _, err := exec.LookPath("ip"); err != nil {
+			t.Skip("no ip command")
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTProxyNetns$", "-test.v")
+		cmd.Env = append(os.Environ(), "TPROXY_NETNS=1")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+		out, err := cmd.CombinedOutput()
+		if err != nil && cmd.ProcessState == nil {
+			t.Skip("network namespace unavailable: ", err)
+		}
+		t.Logf("%s", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	for _, args := range [][]string{
+		{"link", "set", "lo", "up"},
+		{"route", "add", "local", "10.99.0.0/24", "dev", "lo"}} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("ip %v: %v %s", args, err, out)
+		}
+	}
+	tcp_echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp_echo.Close()
+	go func() {
+		for {
+			conn, err := tcp_echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	udp_echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp_echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udp_echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp_echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	dialer := &echoDialer{tcp: tcp_echo.Addr().String(), udp: udp_echo.LocalAddr().String()}
+	ser, err := NewServer("0.0.0.0:7777", dialer, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+	defer ser.Close()
+
+	// the local address of the accepted conn is the original destination
+	conn, err := net.Dial("tcp", "10.99.0.5:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echoRoundTrip(conn, "tcp"); err != nil {
+		t.Error("tcp", err)
+	}
+	conn.Close()
+
+	// a flow per source and destination, the replies come from the
+	// destination
+	c1, err := net.Dial("udp", "10.99.0.5:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("udp", "10.99.0.6:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if err := echoRoundTrip(c1, "a"); err != nil {
+		t.Error("udp flow 1", err)
+	}
+	// without a TPROXY rule the later datagrams would go to the reply
+	// socket bound to the destination, so hand this one to the server
+	c1.SetDeadline(time.Now().Add(3 * time.Second))
+	ser.handleUDP(c1.LocalAddr().(*net.UDPAddr), c1.RemoteAddr().(*net.UDPAddr), []byte("b"))
+	buf := make([]byte, 64)
+	if n, err := c1.Read(buf); err != nil || string(buf[:n]) != "b" {
+		t.Error("udp flow 1 again", err, buf[:n])
+	}
+	if err := echoRoundTrip(c2, "c"); err != nil {
+		t.Error("udp flow 2", err)
+	}
+	want := []string{"tcp 10.99.0.5:7777", "udp 10.99.0.5:7777", "udp 10.99.0.6:7777"}
+	if got := dialer.dialed(); !reflect.DeepEqual(got, want) {
+		t.Error("dials", got)
+	}
+
+	// the idle flows are closed after the timeout
+	time.Sleep(600 * time.Millisecond)
+	ser.lock.Lock()
+	flows := len(ser.flows)
+	ser.lock.Unlock()
+	if flows != 0 {
+		t.Error(flows, "flows after the timeout")
+	}
+	if err := echoRoundTrip(c1, "d"); err != nil {
+		t.Error("udp flow 1 after the timeout", err)
+	}
+	if got := dialer.dialed(); len(got) != 4 || got[3] != "udp 10.99.0.5:7777" {
+		t.Error("dials after the timeout", got)
+	}
+}
@@ -3,6 +3,9 @@ package tunnel
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -63,3 +66,279 @@ func TestCipherEnc(t *testing.T) {
 		t.Error("dec fail")
 	}
 }
+
+func TestCipherRegistry(t *testing.T) {
+	msg := []byte("test message")
+	for _, name := range []string{"rc4", "aes-128-ctr", "aes-256-ctr", "chacha20"} {
+		cfg := GetCipherConfig(name)
+		if cfg == nil {
+			t.Fatal("no such", name)
+		}
+		key, iv := MakeCryptoKeyIV([]byte("1234"), cfg.KeySize, cfg.IVSize)
+		cli_enc, cli_dec, err := cfg.NewCipher(key, iv)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		ser_enc, ser_dec, err := cfg.NewServerCipher(key, iv)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		up, down := make([]byte, len(msg)), make([]byte, len(msg))
+		cli_enc.XORKeyStream(up, msg)
+		ser_enc.XORKeyStream(down, msg)
+		if cfg.perSessionKey() && bytes.Equal(up, down) {
+			t.Error(name, "both directions share a key stream")
+		}
+		ser_dec.XORKeyStream(up, up)
+		cli_dec.XORKeyStream(down, down)
+		if !bytes.Equal(up, msg) || !bytes.Equal(down, msg) {
+			t.Error(name, "dec fail")
+		}
+	}
+
+	if err := CheckCiphers([]string{"aes-256", "rc4"}, ""); err == nil {
+		t.Error("rc4 allowed by default")
+	}
+	if err := CheckCiphers([]string{"aes-256", "rc4"}, "weak"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckCiphers([]string{"chacha20", "aes-256"}, "strong"); err == nil {
+		t.Error("aes-256 allowed by strong")
+	}
+	if err := CheckGlobalCipher("rc4", ""); err == nil {
+		t.Error("rc4 allowed as the global cipher by default")
+	}
+	if err := CheckGlobalCipher("aes-128", "strong"); err != nil {
+		t.Error("strong minimum refused the global cipher", err)
+	}
+	if _, err := LoadGlobalCipherConfig("chacha20", []byte("passwd")); err == nil {
+		t.Error("chacha20 allowed as the global cipher")
+	}
+	if err := RegisterCipher("aes-256", 32, 16, CIPHER_STANDARD, new(AESCipherMaker)); err == nil {
+		t.Error("registered aes-256 twice")
+	}
+}
+
+func TestStrongLink(t *testing.T) {
+	ser, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	ser.config.LinkEncryptMethods = []string{"chacha20", "aes-256"}
+	ser.enc_methods = []byte("chacha20,aes-256")
+
+	for _, c := range []struct {
+		methods []string
+		ok      bool
+	}{{[]string{"chacha20"}, true}, {[]string{"aes-256-ctr"}, false}} {
+		cfg := newTestClientConfig(ser.listenser.Addr().String())
+		cfg.LinkEncryptMethods = c.methods
+		cfg.MinimumSecurity = "strong"
+		cli, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Init(); (err == nil) != c.ok {
+			t.Error(c.methods, "login", err)
+		}
+		cli.Close()
+	}
+}
+
+func TestPickCipher(t *testing.T) {
+	offered := []string{"aes-256-ctr", "chacha20", "aes-256"}
+	local := []string{"chacha20", "aes-256-ctr"}
+	if md := pickCipher(offered, local, CIPHER_PREF_SERVER); md != "aes-256-ctr" {
+		t.Error("server preference picked", md)
+	}
+	if md := pickCipher(offered, local, CIPHER_PREF_CLIENT); md != "chacha20" {
+		t.Error("client preference picked", md)
+	}
+	if md := pickCipher(offered, []string{"rc4"}, CIPHER_PREF_CLIENT); md != "" {
+		t.Error("picked", md)
+	}
+}
+
+func TestChaCha20Rekey(t *testing.T) {
+	m := &DuplexCipherMaker{NewStream: newChaCha20, Rekey: 100}
+	key, iv := MakeCryptoKeyIV([]byte("1234"), 32, 12)
+	enc, _, err := m.NewStreamCipher(key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dec, err := m.NewServerStreamCipher(key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the segments go on across the chunks of both sides
+	msg := make([]byte, 1000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	data := make([]byte, len(msg))
+	for i, n := 0, 0; i < len(msg); i += n {
+		n = 37
+		if i+n > len(msg) {
+			n = len(msg) - i
+		}
+		enc.XORKeyStream(data[i:i+n], msg[i:i+n])
+	}
+	for i, n := 0, 0; i < len(data); i += n {
+		n = 151
+		if i+n > len(data) {
+			n = len(data) - i
+		}
+		dec.XORKeyStream(data[i:i+n], data[i:i+n])
+	}
+	if !bytes.Equal(data, msg) {
+		t.Fatal("decrypt fail")
+	}
+
+	// segment 1 is chacha20 with iv ^ 1
+	enc, _, _ = m.NewStreamCipher(key, iv)
+	ks := make([]byte, 200)
+	enc.XORKeyStream(ks, ks)
+	iv1 := append([]byte(nil), iv...)
+	iv1[11] ^= 1
+	seg1, _ := newChaCha20(key, iv1)
+	want := make([]byte, 100)
+	seg1.XORKeyStream(want, want)
+	if bytes.Equal(ks[:100], ks[100:]) || !bytes.Equal(ks[100:], want) {
+		t.Error("segment 1 key stream")
+	}
+}
+
+func TestAEADLink(t *testing.T) {
+	ser, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	methods := []string{"aes-128-gcm", "aes-256-gcm", "chacha20-poly1305"}
+	ser.config.LinkEncryptMethods = methods
+	ser.enc_methods = []byte(strings.Join(methods, ","))
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	msg := make([]byte, AEAD_RECORD_SIZE*2+100)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for _, method := range methods {
+		cfg := newTestClientConfig(ser.listenser.Addr().String())
+		cfg.LinkEncryptMethods = []string{method}
+		cfg.MinimumSecurity = "strong"
+		cli, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Init(); err != nil {
+			t.Fatal(method, "login", err)
+		}
+		conn, err := cli.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		go conn.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+			t.Error(method, "echo", err)
+		}
+		conn.Close()
+		cli.Close()
+	}
+	if _, err := LoadGlobalCipherConfig("aes-256-gcm", []byte("passwd")); err == nil {
+		t.Error("aes-256-gcm allowed as the global cipher")
+	}
+}
+
+func TestAEADPipeTamper(t *testing.T) {
+	cfg := GetCipherConfig("aes-256-gcm")
+	key, iv := MakeCryptoKeyIV([]byte("1234"), cfg.KeySize, cfg.IVSize)
+	for _, flip := range []int{-1, 1, 30} {
+		// the size record is 2+16 bytes, then the data
+		var sent bytes.Buffer
+		cli := NewStreamPipe(nopCloser{&sent})
+		if err := cfg.SwitchPipe(cli, key, iv, false); err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte("hello world"))
+		data := sent.Bytes()
+		if flip >= 0 {
+			data[flip] ^= 1
+		}
+
+		a, b := net.Pipe()
+		ser := NewStreamPipe(b)
+		if err := cfg.SwitchPipe(ser, key, iv, true); err != nil {
+			t.Fatal(err)
+		}
+		go a.Write(data)
+		buf := make([]byte, 11)
+		_, err := io.ReadFull(ser, buf)
+		if flip < 0 && (err != nil || string(buf) != "hello world") {
+			t.Error("read", err, buf)
+		} else if flip >= 0 && err == nil {
+			t.Error("tampered byte", flip, "not detected")
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (nopCloser) Close() error { return nil }
+
+func TestSignedStartupExt(t *testing.T) {
+	// no global cipher so the relay can find the extensions
+	ser, cleanup := newPlainTestServer(t)
+	defer cleanup()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// key type rsa then the server preference, at the end of the response
+	pref := []byte{STARTUP_EXT_KEY_TYPE, 0, 1, 1, STARTUP_EXT_CIPHER_PREF, 0, 1, CIPHER_PREF_SERVER}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rconn, err := net.Dial("tcp", ser.listenser.Addr().String())
+		if err != nil {
+			return
+		}
+		defer rconn.Close()
+		go io.Copy(rconn, conn)
+
+		var rep []byte
+		buf := make([]byte, 4096)
+		for !bytes.HasSuffix(rep, pref) {
+			n, err := rconn.Read(buf)
+			if err != nil {
+				return
+			}
+			rep = append(rep, buf[:n]...)
+		}
+		rep[len(rep)-1] = CIPHER_PREF_CLIENT
+		conn.Write(rep)
+		io.Copy(conn, rconn)
+	}()
+
+	cfg := newTestClientConfig(l.Addr().String())
+	cfg.GlobalEncryptMethod = ""
+	cli, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Init(); err == nil {
+		t.Error("login with a flipped cipher preference")
+	}
+}
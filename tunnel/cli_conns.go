@@ -1,8 +1,10 @@
 package tunnel
 
 import (
+	"fmt"
 	"github.com/golang/glog"
 	"io"
+	"net"
 	"sync"
 )
 
@@ -10,6 +12,26 @@ type SockChan struct {
 	id     uint32
 	closed bool
 	read   chan []byte
+	// receives the result of PACKET_CONN_OK/PACKET_CONN_FAIL
+	ready chan error
+	// bound and remote address reported by server
+	bnd_addr *net.TCPAddr
+	rmt_addr *net.TCPAddr
+}
+
+// ConnError is a connect failure reported by server
+type ConnError struct {
+	Code uint16
+	Msg  string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("remote connect fail(%d): %s", e.Code, e.Msg)
+}
+
+// SocksReplyCode returns the SOCKS5 REP field, CONN_ERR_* are the same codes
+func (e *ConnError) SocksReplyCode() byte {
+	return byte(e.Code)
 }
 
 type ConnManager struct {
@@ -17,6 +39,7 @@ type ConnManager struct {
 	write_ch chan []byte
 	next_id  uint32
 	lock     sync.RWMutex
+	done     chan struct{}
 }
 
 func NewConnManager(write_ch chan []byte) *ConnManager {
@@ -24,15 +47,60 @@ func NewConnManager(write_ch chan []byte) *ConnManager {
 	cm.chans = make(map[uint32]*SockChan)
 	cm.write_ch = write_ch
 	cm.next_id = 1
+	cm.done = make(chan struct{})
 	return cm
 }
 
-func (cm *ConnManager) newSockChan(rw io.ReadWriteCloser) *SockChan {
+// send queues data to the tunnel, it fails once the manager is closed
+func (cm *ConnManager) send(data []byte) bool {
+	select {
+	case cm.write_ch <- data:
+		return true
+	case <-cm.done:
+		return false
+	}
+}
+
+func (cm *ConnManager) NumConns() int {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	return len(cm.chans)
+}
+
+func (cm *ConnManager) connIds() []uint32 {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	ids := make([]uint32, 0, len(cm.chans))
+	for id := range cm.chans {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Close closes all local conns and refuses new ones
+func (cm *ConnManager) Close() {
+	cm.lock.Lock()
+	select {
+	case <-cm.done:
+	default:
+		close(cm.done)
+	}
+	cm.lock.Unlock()
+	cm.CloseAllConns()
+}
+
+func (cm *ConnManager) newSockChan() *SockChan {
 	sc := new(SockChan)
 	sc.read = make(chan []byte, 128)
+	sc.ready = make(chan error, 1)
 
 	cm.lock.Lock()
 	defer cm.lock.Unlock()
+	select {
+	case <-cm.done:
+		return nil
+	default:
+	}
 	id := cm.next_id
 	for {
 		if _, ok := cm.chans[id]; !ok {
@@ -50,21 +118,15 @@ func (cm *ConnManager) newSockChan(rw io.ReadWriteCloser) *SockChan {
 	return sc
 }
 
-func (cm *ConnManager) delSockChan(conn_id uint32) {
+func (cm *ConnManager) CloseConn(conn_id uint32) {
 	cm.lock.Lock()
+	sc := cm.chans[conn_id]
 	delete(cm.chans, conn_id)
 	cm.lock.Unlock()
-}
-
-func (cm *ConnManager) CloseConn(conn_id uint32) {
-	cm.lock.RLock()
-	sc := cm.chans[conn_id]
-	cm.lock.RUnlock()
 
 	if sc != nil {
 		sc.closed = true
 		close(sc.read)
-		cm.delSockChan(conn_id)
 	}
 }
 
@@ -77,6 +139,34 @@ func (cm *ConnManager) CloseAllConns() {
 	cm.lock.Unlock()
 }
 
+// ConnReply handles PACKET_CONN_OK/PACKET_CONN_FAIL, a failed conn is closed
+func (cm *ConnManager) ConnReply(conn_id uint32, pkt_type byte, data []byte) {
+	cm.lock.RLock()
+	sc := cm.chans[conn_id]
+	cm.lock.RUnlock()
+	if sc == nil {
+		glog.V(2).Infof("reply to deled sock: %d", conn_id)
+		return
+	}
+
+	var err error
+	if pkt_type == PACKET_CONN_OK {
+		sc.bnd_addr, sc.rmt_addr, err = parseConnOk(data)
+	} else if len(data) >= 4 && len(data) >= 4+int(ReadN2(data, 2)) {
+		err = &ConnError{Code: ReadN2(data, 0), Msg: string(data[4 : 4+ReadN2(data, 2)])}
+	} else {
+		err = &ConnError{Code: CONN_ERR_GENERAL, Msg: "invalid conn fail packet"}
+	}
+	select {
+	case sc.ready <- err:
+	default:
+	}
+	if pkt_type == PACKET_CONN_FAIL {
+		glog.V(1).Infof("remote(%d) %v", conn_id, err)
+		cm.CloseConn(conn_id)
+	}
+}
+
 func (cm *ConnManager) WriteToLocalConn(conn_id uint32, data []byte) {
 	defer func() {
 		err := recover()
@@ -96,21 +186,41 @@ func (cm *ConnManager) WriteToLocalConn(conn_id uint32, data []byte) {
 	}
 }
 
-func (cm *ConnManager) DoProxy(conn_type byte, addr []byte, port int, rw io.ReadWriteCloser) {
-	defer rw.Close()
-
-	sc := cm.newSockChan(rw)
+// openConn sends a new conn request, sub_identity is only sent if not empty
+// and must be supported by the server
+func (cm *ConnManager) openConn(conn_type byte, addr []byte, port int, sub_identity string) (*SockChan, error) {
+	sc := cm.newSockChan()
+	if sc == nil {
+		return nil, ErrClientClosed
+	}
 	req := make([]byte, 12+len(addr))
 	req[0] = PROTO_MAGIC
 	req[1] = PACKET_NEW_CONN
-	WriteN2(req, 2, uint16(4+len(addr)))
 	WriteN4(req, 4, sc.id)
 	req[8] = conn_type
 	req[9] = byte(len(addr))
 	WriteN2(req, 10, uint16(port))
 	copy(req[12:], addr)
-	cm.write_ch <- req
+	if sub_identity != "" {
+		req = append(req, byte(len(sub_identity)))
+		req = append(req, sub_identity...)
+	}
+	WriteN2(req, 2, uint16(len(req)-8))
+	if !cm.send(req) {
+		cm.CloseConn(sc.id)
+		return nil, ErrClientClosed
+	}
+	return sc, nil
+}
+
+func (cm *ConnManager) DoProxy(conn_type byte, addr []byte, port int, rw io.ReadWriteCloser) {
+	defer rw.Close()
 
+	sc, err := cm.openConn(conn_type, addr, port, "")
+	if err != nil {
+		glog.V(1).Infof("open conn fail: %v", err)
+		return
+	}
 	cm.copyConn(sc, rw)
 }
 
@@ -124,7 +234,10 @@ func (cm *ConnManager) copyConn(sc *SockChan, rw io.ReadWriteCloser) {
 				bs[1] = PACKET_PROXY
 				WriteN2(bs, 2, uint16(n))
 				WriteN4(bs, 4, sc.id)
-				cm.write_ch <- bs[:8+n]
+				if !cm.send(bs[:8+n]) {
+					exit_ch <- true
+					return
+				}
 			} else {
 				glog.V(1).Infof("read local(%d) fail: %v", sc.id, err)
 				exit_ch <- true
@@ -150,12 +263,7 @@ for_loop:
 		}
 	}
 
-	bs := make([]byte, 8)
-	bs[0] = PROTO_MAGIC
-	bs[1] = PACKET_CLOSE_CONN
-	WriteN2(bs, 2, 0)
-	WriteN4(bs, 4, sc.id)
-	cm.write_ch <- bs
+	cm.send(makeClosePacket(sc.id))
 	cm.CloseConn(sc.id)
 	glog.V(1).Infof("local(%d) closed", sc.id)
 }
@@ -0,0 +1,335 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tunnelAddr is an address that is resolved by server
+type tunnelAddr struct {
+	network string
+	address string
+}
+
+func (a *tunnelAddr) Network() string {
+	return a.network
+}
+
+func (a *tunnelAddr) String() string {
+	return a.address
+}
+
+func (cli *Client) Dial(network, address string) (net.Conn, error) {
+	return cli.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the tunnel. It has the signature
+// of http.Transport.DialContext and implements proxy.ContextDialer.
+func (cli *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return cli.DialContextAs(ctx, "", network, address)
+}
+
+// DialContextAs is DialContext on behalf of the local user sub_identity, the
+// user is sent to server if config.ForwardSubIdentity is set
+func (cli *Client) DialContextAs(ctx context.Context, sub_identity, network, address string) (net.Conn, error) {
+	dial_err := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network,
+			Addr: &tunnelAddr{network, address}, Err: err}
+	}
+
+	datagram := false
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		datagram = true
+	default:
+		return nil, dial_err(net.UnknownNetworkError(network))
+	}
+	host, port_s, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, dial_err(err)
+	}
+	port, err := net.LookupPort(network, port_s)
+	if err != nil {
+		return nil, dial_err(err)
+	}
+	switch action, rule := cli.router.Route(host, port); action {
+	case ROUTE_DIRECT:
+		glog.V(1).Infof("direct %s by %s", address, rule)
+		return new(net.Dialer).DialContext(ctx, network, address)
+	case ROUTE_REJECT:
+		glog.V(1).Infof("reject %s by %s", address, rule)
+		return nil, dial_err(ErrRouteRejected)
+	}
+
+	conn_type, addr := PROTO_ADDR_DOMAIN, []byte(host)
+	if ip := net.ParseIP(host); ip != nil {
+		conn_type, addr = PROTO_ADDR_IP, addrIPBytes(ip)
+	} else if len(addr) == 0 || len(addr) > 255 {
+		return nil, dial_err(fmt.Errorf("invalid host: %q", host))
+	}
+
+	tun, err := cli.pickTunnel(host)
+	if err != nil {
+		return nil, dial_err(err)
+	}
+	if datagram {
+		if tun.server_version < PROTO_VERSION_UDP {
+			return nil, dial_err(fmt.Errorf("server version %d has no udp", tun.server_version))
+		}
+		conn_type |= PROTO_CONN_UDP
+	}
+	if !cli.config.ForwardSubIdentity || tun.server_version < PROTO_VERSION_SUB_IDENTITY {
+		sub_identity = ""
+	} else if len(sub_identity) > 255 {
+		sub_identity = sub_identity[:255]
+	}
+	sc, err := tun.conn_mgr.openConn(conn_type, addr, port, sub_identity)
+	if err != nil {
+		return nil, dial_err(err)
+	}
+	conn := newTunnelConn(tun.conn_mgr, sc, datagram)
+
+	if tun.server_version >= PROTO_VERSION_CONN_REPLY {
+		select {
+		case err := <-sc.ready:
+			if err != nil {
+				conn.Close()
+				return nil, dial_err(err)
+			}
+		case <-ctx.Done():
+			conn.Close()
+			return nil, dial_err(ctx.Err())
+		case <-tun.conn_mgr.done:
+			return nil, dial_err(ErrClientClosed)
+		}
+	}
+
+	conn.laddr, conn.raddr = tun.conn.LocalAddr(), &tunnelAddr{network, address}
+	if sc.bnd_addr != nil {
+		conn.laddr = netAddr(datagram, sc.bnd_addr.IP, sc.bnd_addr.Port)
+	}
+	if sc.rmt_addr != nil {
+		conn.raddr = netAddr(datagram, sc.rmt_addr.IP, sc.rmt_addr.Port)
+	} else if conn_type&^PROTO_CONN_UDP == PROTO_ADDR_IP {
+		conn.raddr = netAddr(datagram, net.IP(addr), port)
+	}
+	return conn, nil
+}
+
+func netAddr(datagram bool, ip net.IP, port int) net.Addr {
+	if datagram {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// tunnelConn is a net.Conn over a tunnel conn, a datagram conn keeps the
+// message boundaries like an UDP conn
+type tunnelConn struct {
+	cm       *ConnManager
+	sc       *SockChan
+	datagram bool
+	laddr    net.Addr
+	raddr    net.Addr
+
+	rlock sync.Mutex
+	rbuf  []byte
+	wlock sync.Mutex
+
+	read_dl    *connDeadline
+	write_dl   *connDeadline
+	close_once sync.Once
+	closed     chan struct{}
+}
+
+func newTunnelConn(cm *ConnManager, sc *SockChan, datagram bool) *tunnelConn {
+	return &tunnelConn{
+		cm:       cm,
+		sc:       sc,
+		datagram: datagram,
+		read_dl:  newConnDeadline(),
+		write_dl: newConnDeadline(),
+		closed:   make(chan struct{})}
+}
+
+func (c *tunnelConn) opError(op string, err error) error {
+	network := "tcp"
+	if c.datagram {
+		network = "udp"
+	}
+	return &net.OpError{Op: op, Net: network, Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
+func (c *tunnelConn) Read(bs []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if len(c.rbuf) == 0 {
+		select {
+		case <-c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		case <-c.read_dl.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		default:
+		}
+
+		select {
+		case data, ok := <-c.sc.read:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.rbuf = data
+		case <-c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		case <-c.read_dl.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+
+	n := copy(bs, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	if c.datagram {
+		// the rest of the datagram is discarded
+		c.rbuf = nil
+	}
+	return n, nil
+}
+
+func (c *tunnelConn) Write(bs []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.datagram && len(bs) > MAX_PROXY_DATA {
+		return 0, c.opError("write", syscall.EMSGSIZE)
+	}
+	written := 0
+	for len(bs) > 0 {
+		select {
+		case <-c.closed:
+			return written, c.opError("write", net.ErrClosed)
+		case <-c.write_dl.wait():
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		default:
+		}
+
+		n := len(bs)
+		if n > MAX_PROXY_DATA {
+			n = MAX_PROXY_DATA
+		}
+		data := make([]byte, 8+n)
+		data[0] = PROTO_MAGIC
+		data[1] = PACKET_PROXY
+		WriteN2(data, 2, uint16(n))
+		WriteN4(data, 4, c.sc.id)
+		copy(data[8:], bs[:n])
+
+		select {
+		case c.cm.write_ch <- data:
+		case <-c.cm.done:
+			return written, c.opError("write", ErrClientClosed)
+		case <-c.closed:
+			return written, c.opError("write", net.ErrClosed)
+		case <-c.write_dl.wait():
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		written += n
+		bs = bs[n:]
+	}
+	return written, nil
+}
+
+func (c *tunnelConn) Close() error {
+	c.close_once.Do(func() {
+		close(c.closed)
+		c.cm.send(makeClosePacket(c.sc.id))
+		c.cm.CloseConn(c.sc.id)
+	})
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.read_dl.set(t)
+	c.write_dl.set(t)
+	return nil
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.read_dl.set(t)
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.write_dl.set(t)
+	return nil
+}
+
+// connDeadline is a channel that is closed when the deadline passes
+type connDeadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newConnDeadline() *connDeadline {
+	return &connDeadline{cancel: make(chan struct{})}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer func is closing cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *connDeadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cancel
+}
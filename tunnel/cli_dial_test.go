@@ -0,0 +1,301 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTunnel starts a server on loopback and a client logged in to it
+func newTestTunnel(t *testing.T) (*Server, *Client, func()) {
+	return newTestTunnelWithOptions(t, nil)
+}
+
+func newTestTunnelWithOptions(t *testing.T, opts *ServerOptions) (*Server, *Client, func()) {
+	ser, ser_cleanup := newTestServer(t, opts)
+	cli, err := NewClient(newTestClientConfig(ser.listenser.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ser, cli, func() {
+		cli.Close()
+		ser_cleanup()
+	}
+}
+
+func newTestClientConfig(server_addr string) *ClientConfig {
+	return &ClientConfig{
+		ServerAddr:            server_addr,
+		GlobalEncryptMethod:   "aes-128",
+		GlobalEncryptPassword: "passwd",
+		LinkEncryptMethods:    []string{"aes-256"},
+		Username:              "user",
+		Password:              "passwd"}
+}
+
+// newTestServer starts a server on loopback with a "user" of "passwd"
+func newTestServer(t *testing.T, opts *ServerOptions) (*Server, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServerOn(t, l, opts)
+}
+
+// newPlainTestServer starts a test server without the global cipher, so the
+// startup is sent in plaintext
+func newPlainTestServer(t *testing.T) (*Server, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestServer(t, l, nil, "")
+}
+
+func newTestServerOn(t *testing.T, l net.Listener, opts *ServerOptions) (*Server, func()) {
+	return startTestServer(t, l, opts, "aes-128")
+}
+
+func startTestServer(t *testing.T, l net.Listener, opts *ServerOptions, global_method string) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(users, []byte("user:\n  password: passwd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ser, err := NewServerWithListener(&ServerConfig{
+		GlobalEncryptMethod:   global_method,
+		GlobalEncryptPassword: "passwd",
+		LinkEncryptMethods:    []string{"aes-256"},
+		KeyPath:               filepath.Join(dir, "rsa_key"),
+		UserConfigPath:        users}, l, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ser.Serve(context.Background())
+
+	return ser, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ser.Shutdown(ctx)
+		cancel()
+		os.RemoveAll(dir)
+	}
+}
+
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestClientDial(t *testing.T) {
+	_, cli, cleanup := newTestTunnel(t)
+	defer cleanup()
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	conn, err := cli.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != echo.Addr().String() {
+		t.Error("remote addr", conn.RemoteAddr(), echo.Addr())
+	}
+	if _, ok := conn.LocalAddr().(*net.TCPAddr); !ok {
+		t.Error("local addr", conn.LocalAddr())
+	}
+
+	msg := make([]byte, 5000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Error("echo not equal")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("expect timeout")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Error("expect timeout, got", err)
+	}
+}
+
+func TestClientDialRefused(t *testing.T) {
+	_, cli, cleanup := newTestTunnel(t)
+	defer cleanup()
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := cli.DialContext(ctx, "tcp", addr)
+	operr, ok := err.(*net.OpError)
+	if !ok {
+		t.Fatal("expect OpError, got", err)
+	}
+	if cerr, ok := operr.Err.(*ConnError); !ok || cerr.Code != CONN_ERR_REFUSED {
+		t.Error("expect refused, got", operr.Err)
+	}
+}
+
+func TestClientDialUDP(t *testing.T) {
+	_, cli, cleanup := newTestTunnel(t)
+	defer cleanup()
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := cli.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Error("remote addr", conn.RemoteAddr())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 16)
+	for _, msg := range []string{"first", "second"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		// a short read discards the rest of the datagram
+		if n, err := conn.Read(buf[:3]); err != nil || string(buf[:n]) != msg[:3] {
+			t.Errorf("read %q %v", buf[:n], err)
+		}
+	}
+	if _, err := conn.Write(make([]byte, MAX_PROXY_DATA+1)); err == nil {
+		t.Error("expect too large datagram fail")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	echoOnce := func(conn net.Conn, msg string) error {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
+	// a running stream keeps working until it is closed by the client
+	ser, cli, cleanup := newTestTunnel(t)
+	defer cleanup()
+	conn, err := cli.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echoOnce(conn, "before"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		done <- ser.Shutdown(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatal("shutdown with a running stream", err)
+	default:
+	}
+	if err := echoOnce(conn, "draining"); err != nil {
+		t.Error("stream cut while draining", err)
+	}
+	if c, err := cli.Dial("tcp", echo.Addr().String()); err == nil {
+		c.Close()
+		t.Error("new stream while draining")
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Error("shutdown", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Error("drained after", d)
+	}
+
+	// the streams still running at the deadline are closed
+	ser, cli, cleanup2 := newTestTunnel(t)
+	defer cleanup2()
+	conn, err = cli.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echoOnce(conn, "before"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := ser.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("shutdown after the deadline", err)
+	}
+	start = time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("stream not closed")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Error("stream not closed", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("stream closed after", d)
+	}
+}
@@ -1,8 +1,10 @@
 package tunnel
 
 import (
-	"crypto"
-	"crypto/rsa"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
 	"fmt"
@@ -11,75 +13,126 @@ import (
 	"math/big"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ClientTunnel struct {
 	cli        *Client
+	up         *upstream
 	session_id SessionId
+	// the logged in session, resumed by the next tunnel of up
 	session    *Session
 	cipher_cfg *CipherConfig
 	cipher_ctx *CipherContext
 
-	conn *net.TCPConn
+	conn net.Conn
 	pipe *StreamPipe
 
-	conn_mgr *ConnManager
-	write_ch chan []byte
+	conn_mgr       *ConnManager
+	write_ch       chan []byte
+	server_version uint16
+	wlock          sync.Mutex
+	closed         bool
 }
 
-func NewClientTunnel(cli *Client) *ClientTunnel {
+func NewClientTunnel(cli *Client, up *upstream) *ClientTunnel {
 	ct := new(ClientTunnel)
 	ct.cli = cli
+	ct.up = up
 	ct.write_ch = make(chan []byte, 1024)
 	ct.conn_mgr = NewConnManager(ct.write_ch)
 	return ct
 }
 
-func (ct *ClientTunnel) Init() error {
-	if conn, err := net.Dial("tcp", ct.cli.config.ServerAddr); err == nil {
-		ct.conn = conn.(*net.TCPConn)
+// connect dials the server and starts the pipe
+func (ct *ClientTunnel) connect(timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if conn, err := ct.up.transport.Dial(ctx, ct.up.cfg.Addr); err == nil {
+		ct.conn = conn
 	} else {
 		return err
 	}
-	ct.conn.SetNoDelay(true)
 
 	ct.pipe = NewStreamPipe(ct.conn)
 	if ct.cli.g_cipher != nil {
 		enc, dec, err := ct.cli.g_cipher.NewCipher()
 		if err != nil {
-			glog.Fatalf("make global enc/dec fail: %s", err.Error())
+			ct.conn.Close()
+			return fmt.Errorf("make global enc/dec fail: %s", err.Error())
 		}
 		ct.pipe.SwitchCipher(enc, dec)
 	}
+	return nil
+}
+
+// Probe does a startup exchange and returns its duration, the tunnel is
+// closed after it
+func (ct *ClientTunnel) Probe(timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	if err := ct.connect(timeout); err != nil {
+		return 0, err
+	}
+	defer ct.pipe.Close()
 
+	ct.conn.SetDeadline(start.Add(timeout))
 	if err := ct.startup(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (ct *ClientTunnel) Init() error {
+	timeout := ct.cli.config.ServerCheckTimeout
+	if err := ct.connect(timeout); err != nil {
 		return err
 	}
 
-	if err := ct.login(); err != nil {
+	ct.conn.SetDeadline(time.Now().Add(timeout))
+	if err := ct.handshake(); err != nil {
+		ct.pipe.Close()
 		return err
 	}
+	ct.conn.SetDeadline(time.Time{})
 
 	go func() {
 		for {
-			if data, ok := <-ct.write_ch; ok {
+			select {
+			case data := <-ct.write_ch:
 				conn_id := ReadN4(data, 4)
-				if n, err := ct.pipe.Write(data); err != nil {
-					glog.Fatalf("pipe write fail: %v", err)
+				ct.wlock.Lock()
+				if ct.closed {
+					ct.wlock.Unlock()
+					return
+				}
+				n, err := ct.pipe.Write(data)
+				ct.wlock.Unlock()
+				if err != nil {
+					glog.Errorf("pipe(%s) write fail: %v", ct.up.cfg.Addr, err)
+					ct.Close()
+					return
 				} else {
 					glog.V(3).Infof("remote(%d) written %d", conn_id, n-8)
 				}
-			} else {
-				break
+			case <-ct.conn_mgr.done:
+				return
 			}
 		}
 	}()
 
 	go func() {
+		defer ct.Close()
 		for {
 			buf := make([]byte, 2048)
 			if _, err := io.ReadFull(ct.pipe, buf[:8]); err != nil {
-				glog.Errorf("read from server fail: %s", err.Error())
+				if !ct.isClosed() {
+					glog.Errorf("read from server(%s) fail: %s", ct.up.cfg.Addr, err.Error())
+				}
 				break
 			} else {
 				if buf[0] != PROTO_MAGIC {
@@ -106,6 +159,8 @@ func (ct *ClientTunnel) Init() error {
 				case PACKET_CLOSE_CONN:
 					glog.V(2).Infof("remote close %d", conn_id)
 					ct.conn_mgr.CloseConn(conn_id)
+				case PACKET_CONN_OK, PACKET_CONN_FAIL:
+					ct.conn_mgr.ConnReply(conn_id, buf[1], pkt_data)
 				}
 			}
 		}
@@ -114,13 +169,180 @@ func (ct *ClientTunnel) Init() error {
 	return nil
 }
 
+func (ct *ClientTunnel) isClosed() bool {
+	ct.wlock.Lock()
+	defer ct.wlock.Unlock()
+	return ct.closed
+}
+
+// Close sends close packets for every running connection, then closes the
+// local conns and the connection to server
+func (ct *ClientTunnel) Close() error {
+	conn_ids := ct.conn_mgr.connIds()
+
+	ct.wlock.Lock()
+	if ct.closed {
+		ct.wlock.Unlock()
+		return nil
+	}
+	for _, conn_id := range conn_ids {
+		if _, err := ct.pipe.Write(makeClosePacket(conn_id)); err != nil {
+			glog.V(1).Infof("write close(%d) fail: %v", conn_id, err)
+			break
+		}
+	}
+	ct.closed = true
+	ct.wlock.Unlock()
+
+	ct.conn_mgr.Close()
+	return ct.pipe.Close()
+}
+
+// readStartupExt reads the extensions of a Startup Response by type, raw is
+// ext_size and ext for the signature
+func readStartupExt(r io.Reader) (map[byte][]byte, []byte, error) {
+	raw := make([]byte, 2)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, err
+	}
+	raw = append(raw, make([]byte, ReadN2(raw, 0))...)
+	if _, err := io.ReadFull(r, raw[2:]); err != nil {
+		return nil, nil, err
+	}
+
+	exts := make(map[byte][]byte)
+	for ext := raw[2:]; len(ext) > 0; {
+		if len(ext) < 3 || len(ext) < 3+int(ReadN2(ext, 1)) {
+			return nil, nil, fmt.Errorf("invalid startup ext")
+		}
+		size := int(ReadN2(ext, 1))
+		exts[ext[0]] = ext[3 : 3+size]
+		ext = ext[3+size:]
+	}
+	return exts, raw, nil
+}
+
+// pickCipher returns the first method of offered that local has, or the
+// first of local that offered has if the server asks for client preference
+func pickCipher(offered, local []string, pref byte) string {
+	first, second := offered, local
+	if pref == CIPHER_PREF_CLIENT {
+		first, second = local, offered
+	}
+	for _, md := range first {
+		for _, md_opt := range second {
+			if md == md_opt {
+				return md
+			}
+		}
+	}
+	return ""
+}
+
+// checkKeyRotation checks that the pinned key endorsed the server key pub
+// and the endorsement is not expired
+func checkKeyRotation(pin, pub, rotation []byte) error {
+	if rotation == nil {
+		return fmt.Errorf("no key rotation")
+	}
+	r, err := ParseKeyRotation(rotation)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(r.OldPublicKey, pin) {
+		return fmt.Errorf("rotated from another key %s", derFingerprint(r.OldPublicKey))
+	}
+	if time.Now().After(r.Expire) {
+		return fmt.Errorf("key rotation expired at %v", r.Expire)
+	}
+	return r.Verify(pub)
+}
+
+// handshake resumes the session of the previous tunnel if the server can
+// reuse it, or logs in after a new cipher exchange
+func (ct *ClientTunnel) handshake() error {
+	if ct.session != nil && ct.server_version >= PROTO_VERSION_REUSE {
+		if reused, err := ct.reuse(); err != nil || reused {
+			return err
+		}
+	} else if err := ct.startup(); err != nil {
+		return err
+	}
+	return ct.login()
+}
+
+// reuse sends a reuse request of ct.session, it returns false after the
+// cipher exchange the server starts if the session can't be reused
+func (ct *ClientTunnel) reuse() (bool, error) {
+	s := ct.session
+	sid, err := s.Id.Bytes()
+	if err != nil {
+		return false, err
+	}
+	cli_rand := make([]byte, REUSE_RANDOM_SIZE)
+	if _, err := rand.Read(cli_rand); err != nil {
+		return false, err
+	}
+	mac := hmac.New(sha256.New, s.CipherCtx.CryptoKey)
+	mac.Write(cli_rand)
+	req := []byte{PROTO_MAGIC, byte(len(sid)), byte(len(cli_rand)), sha256.Size}
+	req = append(append(append(req, sid...), cli_rand...), mac.Sum(nil)...)
+	if _, err := ct.pipe.Write(req); err != nil {
+		glog.Errorf("send reuse req fail: %s", err.Error())
+		return false, err
+	}
+
+	rep := make([]byte, 5)
+	if _, err := io.ReadFull(ct.pipe, rep[:2]); err != nil {
+		glog.Errorf("recv reuse rep fail: %s", err.Error())
+		return false, err
+	}
+	if rep[0] != B_TRUE {
+		if rep[1]&REUSE_FAIL_START_CIPHER_EXCHANGE == 0 {
+			return false, fmt.Errorf("reuse session fail: %d", rep[1])
+		}
+		glog.V(1).Infof("reuse session %s fail: %d, login again",
+			s.Id, rep[1]&^REUSE_FAIL_START_CIPHER_EXCHANGE)
+		return false, ct.cipherExchange()
+	}
+	if _, err := io.ReadFull(ct.pipe, rep[2:]); err != nil {
+		glog.Errorf("recv reuse rep fail: %s", err.Error())
+		return false, err
+	}
+	rep = append(rep, make([]byte, int(rep[4])+sha256.Size)...)
+	if _, err := io.ReadFull(ct.pipe, rep[5:]); err != nil {
+		glog.Errorf("recv reuse rep body fail: %s", err.Error())
+		return false, err
+	}
+	proof := rep[len(rep)-sha256.Size:]
+	rep = rep[:len(rep)-sha256.Size]
+	if !hmac.Equal(proof, reuseMAC(s.CipherCtx.CryptoKey, "breaksocks reuse proof", cli_rand, rep[2:])) {
+		return false, fmt.Errorf("invalid reuse proof of server")
+	}
+
+	key, iv := reuseKeyIV(s.CipherCtx.CryptoKey, cli_rand, rep[5:], s.CipherConfig)
+	if err := s.CipherConfig.SwitchPipe(ct.pipe, key, iv, false); err != nil {
+		glog.Errorf("new link cipher fail: %s", err.Error())
+		return false, err
+	}
+	ct.server_version = ReadN2(rep, 2)
+	ct.session_id, ct.cipher_cfg = s.Id, s.CipherConfig
+	glog.Infof("reuse %s ok, sessionId: %s, cipher: %s", ct.up.cfg.Addr, ct.session_id, ct.cipher_cfg.Name)
+	return true, nil
+}
+
 func (ct *ClientTunnel) startup() error {
-	req_header := []byte{PROTO_MAGIC, 0, 0, 0}
+	req_header := []byte{PROTO_MAGIC, 0, STARTUP_VERSION_EXT, 0}
 	if _, err := ct.pipe.Write(req_header[:]); err != nil {
 		glog.Errorf("send startup req fail: %s", err.Error())
 		return err
 	}
+	return ct.cipherExchange()
+}
 
+// cipherExchange reads a Startup Response and switches the pipe to the link
+// cipher
+func (ct *ClientTunnel) cipherExchange() error {
 	header := make([]byte, 10)
 	if _, err := io.ReadFull(ct.pipe, header[:]); err != nil {
 		glog.Errorf("recv startup rep header fail: %s", err.Error())
@@ -130,6 +352,8 @@ func (ct *ClientTunnel) startup() error {
 	pub_size, p_size := ReadN2(header, 0), ReadN2(header, 2)
 	f_size, sig_size := ReadN2(header, 4), ReadN2(header, 6)
 	mds_size := ReadN2(header, 8)
+	has_ext := pub_size&STARTUP_EXT_FLAG != 0
+	pub_size &^= STARTUP_EXT_FLAG
 	if pub_size == 0 || p_size == 0 || f_size == 0 || sig_size == 0 || mds_size == 0 {
 		return fmt.Errorf("invalid size pub:%d p:%d f:%d sig:%d mds:%d",
 			pub_size, p_size, f_size, sig_size, mds_size)
@@ -140,23 +364,49 @@ func (ct *ClientTunnel) startup() error {
 		glog.Errorf("recv startup rep body fail: %s", err.Error())
 		return err
 	}
+	var exts map[byte][]byte
+	var raw_ext []byte
+	if has_ext {
+		var err error
+		if exts, raw_ext, err = readStartupExt(ct.pipe); err != nil {
+			glog.Errorf("recv startup rep ext fail: %s", err.Error())
+			return err
+		}
+	}
 
-	var pub_key *rsa.PublicKey
-	if pubk, err := x509.ParsePKIXPublicKey(body[:pub_size]); err == nil {
-		if rsa_pub, ok := pubk.(*rsa.PublicKey); ok {
-			pub_key = rsa_pub
-		} else {
-			glog.Errorf("invalid pubkey: %#v", pubk)
-			return fmt.Errorf("invalid server pubkey")
+	if ct.up.pin != nil && !bytes.Equal(ct.up.pin, body[:pub_size]) {
+		if err := checkKeyRotation(ct.up.pin, body[:pub_size], exts[STARTUP_EXT_KEY_ROTATION]); err != nil {
+			glog.Errorf("server(%s) pubkey %s not match the pinned one: %v",
+				ct.up.cfg.Addr, derFingerprint(body[:pub_size]), err)
+			return fmt.Errorf("server pubkey not match")
 		}
-	} else {
+		glog.Warningf("server(%s) key rotated to %s, update %s before the previous key expires",
+			ct.up.cfg.Addr, derFingerprint(body[:pub_size]), ct.up.cfg.ServerPublicKeyPath)
+	}
+	pub_key, err := x509.ParsePKIXPublicKey(body[:pub_size])
+	if err != nil {
 		glog.Errorf("parse pubkey fail: %s", err.Error())
 		return err
 	}
+	key_type := keyTypeOf(pub_key)
+	if key_type == 0 {
+		glog.Errorf("invalid pubkey: %#v", pub_key)
+		return fmt.Errorf("invalid server pubkey")
+	}
+	// the key type extension must match pub, older servers send none
+	if ext, ok := exts[STARTUP_EXT_KEY_TYPE]; ok && (len(ext) != 1 || ext[0] != key_type) {
+		glog.Errorf("server key type %v not match the %s pubkey", ext, KeyType(pub_key))
+		return fmt.Errorf("server key type not match")
+	}
 
-	dgst := sha256.Sum256(body[pub_size : pub_size+p_size+1+f_size])
 	sig := body[body_size-mds_size-sig_size : body_size-mds_size]
-	if err := rsa.VerifyPKCS1v15(pub_key, crypto.SHA256, dgst[:], sig); err != nil {
+	signed := body[pub_size : pub_size+p_size+1+f_size]
+	if has_ext {
+		// the methods and extensions are signed too, or the preference
+		// could be flipped on the way
+		signed = append(append(append([]byte(nil), signed...), body[body_size-mds_size:]...), raw_ext...)
+	}
+	if err := verifyData(pub_key, signed, sig); err != nil {
 		glog.Errorf("verify sig fail: %s", err.Error())
 		return err
 	}
@@ -170,21 +420,25 @@ func (ct *ClientTunnel) startup() error {
 	ct.cipher_ctx.CalcKey(new(big.Int).SetBytes(f))
 
 	mds := strings.Split(string(body[body_size-mds_size:]), ",")
-	var method string
-	for _, md_opt := range mds {
-		for _, md := range ct.cli.config.LinkEncryptMethods {
-			if md == md_opt {
-				method = md
-				break
-			}
-		}
-		if method != "" {
-			break
-		}
+	pref := byte(CIPHER_PREF_SERVER)
+	if ext, ok := exts[STARTUP_EXT_CIPHER_PREF]; ok && len(ext) == 1 {
+		pref = ext[0]
 	}
+	method := pickCipher(mds, ct.cli.config.LinkEncryptMethods, pref)
 	if method == "" {
 		glog.Errorf("enc method not match, server(%s) local(%s)",
 			strings.Join(mds, ", "), strings.Join(ct.cli.config.LinkEncryptMethods, ", "))
+		min_sec, _ := ParseCipherSecurity(ct.cli.config.MinimumSecurity)
+		var weak []string
+		for _, md := range mds {
+			if cfg := GetCipherConfig(md); cfg != nil && cfg.Security < min_sec {
+				weak = append(weak, md)
+			}
+		}
+		if len(weak) > 0 {
+			return fmt.Errorf("enc method not match, the server offers %s below MinimumSecurity %s",
+				strings.Join(weak, ","), min_sec)
+		}
 		return fmt.Errorf("enc method not match")
 	}
 	ct.cipher_cfg = GetCipherConfig(method)
@@ -205,18 +459,16 @@ func (ct *ClientTunnel) startup() error {
 	}
 
 	key, iv := ct.cipher_ctx.MakeCryptoKeyIV(ct.cipher_cfg.KeySize, ct.cipher_cfg.IVSize)
-	if enc, dec, err := ct.cipher_cfg.NewCipher(key, iv); err != nil {
-		glog.Errorf("new stream cipher fail: %s", err.Error())
+	if err := ct.cipher_cfg.SwitchPipe(ct.pipe, key, iv, false); err != nil {
+		glog.Errorf("new link cipher fail: %s", err.Error())
 		return err
-	} else {
-		ct.pipe.SwitchCipher(enc, dec)
 	}
 
 	return nil
 }
 
 func (ct *ClientTunnel) login() error {
-	u, p := []byte(ct.cli.config.Username), []byte(ct.cli.config.Password)
+	u, p := []byte(ct.up.cfg.Username), []byte(ct.up.cfg.Password)
 	buf := make([]byte, 4+len(u)+len(p))
 	WriteN2(buf, 0, PROTO_VERSION)
 	buf[2] = byte(len(u))
@@ -242,9 +494,12 @@ func (ct *ClientTunnel) login() error {
 		return err
 	}
 
+	ct.server_version = ReadN2(buf, 0)
 	if buf[2] == B_TRUE {
 		ct.session_id = SessionIdFromBytes(body)
-		glog.Infof("login ok, sessionId: %s", ct.session_id)
+		ct.session = &Session{Id: ct.session_id, Username: ct.up.cfg.Username,
+			CipherCtx: ct.cipher_ctx, CipherConfig: ct.cipher_cfg}
+		glog.Infof("login %s ok, sessionId: %s, cipher: %s", ct.up.cfg.Addr, ct.session_id, ct.cipher_cfg.Name)
 	} else {
 		glog.Errorf("login fail: %s", string(body))
 		return fmt.Errorf("login fail")
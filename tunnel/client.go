@@ -1,59 +1,215 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/golang/glog"
 	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ErrClientClosed = errors.New("tunnel: client closed")
+var ErrRouteRejected error = routeError("tunnel: rejected by route rule")
+
+type routeError string
+
+func (e routeError) Error() string {
+	return string(e)
+}
+
+func (e routeError) SocksReplyCode() byte {
+	return CONN_ERR_NOT_ALLOWED
+}
+
 type Client struct {
 	user   *Session
 	config *ClientConfig
 
-	g_cipher   *GlobalCipherConfig
-	cipher_cfg *CipherConfig
-	cipher_ctx *CipherContext
-	session_id SessionId
+	g_cipher  *GlobalCipherConfig
+	upstreams []*upstream
 
-	//tunnels []*ClientTunnel
-	tun *ClientTunnel
+	router       *Router
+	direct_conns int32
+
+	close_once sync.Once
+	done       chan struct{}
 }
 
 func NewClient(config *ClientConfig) (*Client, error) {
 	glog.V(1).Infof("%#v", config)
 	cli := new(Client)
 	var err error
+	if err := CheckCiphers(config.LinkEncryptMethods, config.MinimumSecurity); err != nil {
+		return nil, err
+	}
 	if config.GlobalEncryptMethod != "" {
+		if err := CheckGlobalCipher(config.GlobalEncryptMethod, config.MinimumSecurity); err != nil {
+			return nil, err
+		}
 		if cli.g_cipher, err = LoadGlobalCipherConfig(
 			config.GlobalEncryptMethod, []byte(config.GlobalEncryptPassword)); err != nil {
 			return nil, err
 		}
 	}
 
+	if cli.router, err = NewRouter(config.Rules, config.DefaultRoute); err != nil {
+		return nil, err
+	}
+	if cli.upstreams, err = newUpstreams(config); err != nil {
+		return nil, err
+	}
+	switch config.ServerSelect {
+	case "":
+		config.ServerSelect = SERVER_SELECT_PRIORITY
+	case SERVER_SELECT_PRIORITY, SERVER_SELECT_LATENCY, SERVER_SELECT_HASH:
+	default:
+		return nil, fmt.Errorf("no such server select: %s", config.ServerSelect)
+	}
+	if config.ServerCheckInterval <= 0 {
+		config.ServerCheckInterval = 30 * time.Second
+	}
+	if config.ServerCheckTimeout <= 0 {
+		config.ServerCheckTimeout = 5 * time.Second
+	}
+
 	cli.config = config
+	cli.done = make(chan struct{})
 	return cli, nil
 }
 
+// Route returns the route action for host:port and the matched rule
+func (cli *Client) Route(host string, port int) (RouteAction, string) {
+	return cli.router.Route(host, port)
+}
+
+// Init connects to the first usable server, with several servers it also
+// starts the health check
 func (cli *Client) Init() error {
-	tun := NewClientTunnel(cli)
-	if err := tun.Init(); err != nil {
-		return err
+	if len(cli.upstreams) > 1 {
+		cli.probeUpstreams()
+		go cli.checkUpstreams()
 	}
-	cli.tun = tun
+	_, err := cli.pickTunnel("")
+	return err
+}
+
+func (cli *Client) isClosed() bool {
+	select {
+	case <-cli.done:
+		return true
+	default:
+		return false
+	}
+}
 
-	cli.session_id = tun.session_id
-	cli.cipher_cfg = tun.cipher_cfg
-	cli.cipher_ctx = tun.cipher_ctx
+func (cli *Client) numConns() int {
+	n := int(atomic.LoadInt32(&cli.direct_conns))
+	for _, up := range cli.upstreams {
+		if tun := up.current(); tun != nil {
+			n += tun.conn_mgr.NumConns()
+		}
+	}
+	return n
+}
 
-	return nil
+// Shutdown waits for the running connections to finish until ctx is done,
+// then closes the tunnels
+func (cli *Client) Shutdown(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for cli.numConns() > 0 {
+		select {
+		case <-ctx.Done():
+			glog.Infof("shutdown timeout, close %d conns", cli.numConns())
+			cli.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return cli.Close()
 }
 
-func (cli *Client) Close() {
+func (cli *Client) Close() error {
+	cli.close_once.Do(func() {
+		close(cli.done)
+	})
+
+	var err error
+	for _, up := range cli.upstreams {
+		if tun := up.current(); tun != nil {
+			if cerr := tun.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
 }
 
 func (cli *Client) DoDomainProxy(domain string, port int, rw io.ReadWriteCloser) {
-	cli.tun.conn_mgr.DoProxy(PROTO_ADDR_DOMAIN, []byte(domain), port, rw)
+	if cli.routeProxy(domain, port, rw) {
+		cli.tunnelProxy(PROTO_ADDR_DOMAIN, []byte(domain), domain, port, rw)
+	}
 }
 
 func (cli *Client) DoIPProxy(addr []byte, port int, rw io.ReadWriteCloser) {
-	cli.tun.conn_mgr.DoProxy(PROTO_ADDR_IP, addr, port, rw)
+	host := net.IP(addr).String()
+	if cli.routeProxy(host, port, rw) {
+		cli.tunnelProxy(PROTO_ADDR_IP, addr, host, port, rw)
+	}
+}
+
+func (cli *Client) tunnelProxy(conn_type byte, addr []byte, host string, port int, rw io.ReadWriteCloser) {
+	tun, err := cli.pickTunnel(host)
+	if err != nil {
+		glog.Errorf("no server for %s:%d: %v", host, port, err)
+		rw.Close()
+		return
+	}
+	tun.conn_mgr.DoProxy(conn_type, addr, port, rw)
+}
+
+// routeProxy handles the DIRECT and REJECT routes, it returns true if the
+// conn should go through the tunnel
+func (cli *Client) routeProxy(host string, port int, rw io.ReadWriteCloser) bool {
+	action, rule := cli.router.Route(host, port)
+	switch action {
+	case ROUTE_DIRECT:
+		glog.V(1).Infof("direct %s:%d by %s", host, port, rule)
+		cli.directProxy(host, port, rw)
+		return false
+	case ROUTE_REJECT:
+		glog.V(1).Infof("reject %s:%d by %s", host, port, rule)
+		rw.Close()
+		return false
+	}
+	return true
+}
+
+func (cli *Client) directProxy(host string, port int, rw io.ReadWriteCloser) {
+	defer rw.Close()
+	atomic.AddInt32(&cli.direct_conns, 1)
+	defer atomic.AddInt32(&cli.direct_conns, -1)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		glog.V(1).Infof("direct conn %s:%d fail: %v", host, port, err)
+		return
+	}
+	defer conn.Close()
+
+	exit_ch := make(chan bool, 2)
+	go func() {
+		io.Copy(conn, rw)
+		exit_ch <- true
+	}()
+	go func() {
+		io.Copy(rw, conn)
+		exit_ch <- true
+	}()
+	<-exit_ch
 }
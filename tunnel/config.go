@@ -4,10 +4,12 @@ import (
 	"gopkg.in/yaml.v2"
 	"io"
 	"os"
+	"time"
 )
 
 const defaultKeyPath = "rsa_key"
 const defaultUserConfigPath = "users"
+const defaultSessionStorePath = "sessions"
 
 type ServerConfig struct {
 	ListenAddr            string
@@ -15,25 +17,126 @@ type ServerConfig struct {
 	GlobalEncryptPassword string
 	LinkEncryptMethods    []string
 
+	// weak, standard (default) or strong, the link ciphers below are
+	// refused, the global cipher only needs standard
+	MinimumSecurity string
+	// "server" (default): the clients pick the first of LinkEncryptMethods
+	// they support, "client": the clients pick by their own order
+	CipherPreference string
+
 	UserConfigPath string
 	KeyPath        string
+	// type of the key generated if KeyPath does not exist: rsa (default),
+	// ed25519 or ecdsa, clients before the key type extension only verify rsa
+	KeyType string
+
+	SessionStore     string
+	SessionStorePath string
+	SessionStoreKey  string
+	// lifetime of a resumable session, DEFAULT_SESSION_TTL if 0
+	SessionTTL time.Duration
+
+	TransportConfig `yaml:",inline"`
+}
+
+type UpstreamConfig struct {
+	Addr     string
+	Username string
+	Password string
+	// the server must use this key if set
+	ServerPublicKeyPath string
+	// lower is preferred by the priority select
+	Priority int
+	// the transport of ClientConfig if Transport is empty
+	TransportConfig `yaml:",inline"`
+}
+
+// DNSRule matches the queries for DomainSuffix, Action is "tunnel" (the
+// default), "direct" or "block"
+type DNSRule struct {
+	DomainSuffix []string
+	Action       string
+	// resolvers of the rule like DNSRemoteAddr, queried directly for direct
+	// rules and through the tunnel otherwise; the DNSRemoteAddr resolvers if
+	// empty
+	Resolvers []string
+	// answer of the blocked queries, "nxdomain" (the default) or "zero" for
+	// 0.0.0.0 and ::
+	BlockWith string
 }
 
 type ClientConfig struct {
 	ServerAddr      string
 	SocksListenAddr string
+	HTTPListenAddr  string
 	RedirListenAddr string
 	DNSListenAddr   string
 	DNSListenOnTCP  bool
-	DNSRemoteAddr   string
+	// "host:port" or a tcp://, tls:// or https:// url, reached through the
+	// tunnel
+	DNSRemoteAddr string
+	// more resolvers tried in turn after DNSRemoteAddr, or all at once with
+	// the first answer winning if DNSRaceUpstreams
+	DNSRemoteAddrs   []string
+	DNSRaceUpstreams bool
+	// persistent streams per resolver
+	DNSStreams      int
+	DNSQueryTimeout time.Duration
+	// 0 for the default 2, negative for no retry
+	DNSRetries int
+	// cached responses, 0 disables the cache; expired entries are served for
+	// DNSCacheServeStale if the resolvers fail
+	DNSCacheSize       int
+	DNSCacheServeStale time.Duration
+	DNSCachePrefetch   bool
+	// first matched rule decides the resolvers of a query, the others go
+	// through the tunnel
+	DNSRules []DNSRule
+	// /etc/hosts format, overrides the A/AAAA answers
+	DNSHostsFile string
+	// fake-IP mode: the A/AAAA queries not matched by DNSRules are answered
+	// from an IPv4 and an optional IPv6 range, like 198.18.0.0/15, and the
+	// redirect listener connects the fake IPs to their domains, both run
+	// by breaksocks client.
+	DNSFakeIPRanges []string
+	// max domains mapped, 65536 if 0
+	DNSFakeIPSize int
+
+	// TPROXY listener for TCP and UDP, UDP flows are closed after idle for
+	// TProxyUDPTimeout
+	TProxyListenAddr string
+	TProxyUDPTimeout time.Duration
+
+	// local proxy auth, no auth is allowed from anywhere if both are empty
+	SocksNoAuthCIDR []string
+	// "user:password" per line
+	SocksUserFile string
+	// send the local proxy user to server with each connection
+	ForwardSubIdentity bool
 
 	GlobalEncryptMethod   string
 	GlobalEncryptPassword string
 	LinkEncryptMethods    []string
 	ServerPublicKeyPath   string
+	// same as ServerConfig.MinimumSecurity
+	MinimumSecurity string
 
 	Username string
 	Password string
+
+	TransportConfig `yaml:",inline"`
+
+	// used instead of ServerAddr/Username/Password/ServerPublicKeyPath and
+	// the transport if set
+	Servers []UpstreamConfig
+	// priority, latency or hash
+	ServerSelect        string
+	ServerCheckInterval time.Duration
+	ServerCheckTimeout  time.Duration
+
+	// first matched rule decides the route, DefaultRoute if none matched
+	Rules        []RouteRule
+	DefaultRoute string
 }
 
 func LoadYamlConfig(path string, obj interface{}) error {
@@ -58,10 +161,11 @@ func LoadServerConfig(path string) (*ServerConfig, error) {
 	cfg.ListenAddr = "0.0.0.0:8989"
 	cfg.GlobalEncryptMethod = "3des-192"
 	cfg.GlobalEncryptPassword = "passwd"
-	cfg.LinkEncryptMethods = []string{"aes-256", "aes-192", "aes-128",
-		"3des-192", "rc4"}
+	cfg.LinkEncryptMethods = defaultLinkEncryptMethods()
 	cfg.KeyPath = defaultKeyPath
 	cfg.UserConfigPath = defaultUserConfigPath
+	cfg.SessionStore = SESSION_STORE_MEMORY
+	cfg.SessionStorePath = defaultSessionStorePath
 	if err := LoadYamlConfig(path, cfg); err != nil {
 		return nil, err
 	}
@@ -75,8 +179,13 @@ func LoadClientConfig(path string) (*ClientConfig, error) {
 	cfg.GlobalEncryptPassword = "passwd"
 	cfg.DNSListenOnTCP = false
 	cfg.DNSRemoteAddr = "8.8.8.8:53"
-	cfg.LinkEncryptMethods = []string{"aes-256", "aes-192", "aes-128",
-		"3des-192", "rc4"}
+	cfg.DNSCacheSize = 4096
+	cfg.DNSCachePrefetch = true
+	cfg.DefaultRoute = "tunnel"
+	cfg.ServerSelect = SERVER_SELECT_PRIORITY
+	cfg.ServerCheckInterval = 30 * time.Second
+	cfg.ServerCheckTimeout = 5 * time.Second
+	cfg.LinkEncryptMethods = defaultLinkEncryptMethods()
 	if err := LoadYamlConfig(path, cfg); err != nil {
 		return nil, err
 	}
@@ -5,24 +5,128 @@ import (
 	"crypto/cipher"
 	"crypto/des"
 	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+	"strings"
+	"sync"
 )
 
-type cipherMaker interface {
+// CipherMaker makes the stream ciphers of a registered cipher
+type CipherMaker interface {
 	// return encrypter/ decrypter
 	NewStreamCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error)
 }
 
+// ServerCipherMaker is implemented by the CipherMakers whose two directions
+// use distinct key streams, the server side gets the directions swapped
+type ServerCipherMaker interface {
+	NewServerStreamCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error)
+}
+
+// CipherSecurity ranks the ciphers for MinimumSecurity
+type CipherSecurity int
+
+const (
+	// broken ciphers kept for old peers: rc4, des
+	CIPHER_WEAK CipherSecurity = iota
+	// the block ciphers in CFB mode
+	CIPHER_STANDARD
+	// AES-GCM and ChaCha20-Poly1305, AES-CTR and ChaCha20 with a key stream
+	// per direction
+	CIPHER_STRONG
+)
+
+var cipherSecurityNames = []string{"weak", "standard", "strong"}
+
+func (sec CipherSecurity) String() string {
+	if sec >= 0 && int(sec) < len(cipherSecurityNames) {
+		return cipherSecurityNames[sec]
+	}
+	return fmt.Sprintf("CipherSecurity(%d)", int(sec))
+}
+
+// ParseCipherSecurity parses a MinimumSecurity, empty is standard
+func ParseCipherSecurity(name string) (CipherSecurity, error) {
+	if name == "" {
+		return CIPHER_STANDARD, nil
+	}
+	for i, sec_name := range cipherSecurityNames {
+		if sec_name == name {
+			return CipherSecurity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("no such security level: %s (%s)", name, strings.Join(cipherSecurityNames, ", "))
+}
+
 type CipherConfig struct {
-	Name    string
-	KeySize int
-	IVSize  int
-	maker   cipherMaker
+	Name     string
+	KeySize  int
+	IVSize   int
+	Security CipherSecurity
+	maker    CipherMaker
 }
 
+// NewCipher returns the encrypter/decrypter of the client side
 func (ctx *CipherConfig) NewCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
 	return ctx.maker.NewStreamCipher(key, iv)
 }
 
+// NewServerCipher returns the encrypter/decrypter of the server side
+func (ctx *CipherConfig) NewServerCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
+	if m, ok := ctx.maker.(ServerCipherMaker); ok {
+		return m.NewServerStreamCipher(key, iv)
+	}
+	return ctx.maker.NewStreamCipher(key, iv)
+}
+
+// perSessionKey reports whether the key stream repeats with the key/iv, such
+// ciphers can't be the global cipher whose key/iv is fixed
+func (ctx *CipherConfig) perSessionKey() bool {
+	if _, ok := ctx.maker.(*AEADCipherMaker); ok {
+		return true
+	}
+	_, ok := ctx.maker.(ServerCipherMaker)
+	return ok
+}
+
+// SwitchPipe switches pipe to the cipher with key/iv, is_server takes the
+// server side of the directions
+func (ctx *CipherConfig) SwitchPipe(pipe *StreamPipe, key, iv []byte, is_server bool) error {
+	if m, ok := ctx.maker.(*AEADCipherMaker); ok {
+		seal, err := m.NewAEAD(key)
+		if err != nil {
+			return err
+		}
+		open, err := m.NewAEAD(key)
+		if err != nil {
+			return err
+		}
+		up_iv, down_iv := duplexIVs(iv)
+		if is_server {
+			pipe.SwitchAEAD(seal, open, down_iv, up_iv)
+		} else {
+			pipe.SwitchAEAD(seal, open, up_iv, down_iv)
+		}
+		return nil
+	}
+
+	var enc, dec cipher.Stream
+	var err error
+	if is_server {
+		enc, dec, err = ctx.NewServerCipher(key, iv)
+	} else {
+		enc, dec, err = ctx.NewCipher(key, iv)
+	}
+	if err != nil {
+		return err
+	}
+	pipe.SwitchCipher(enc, dec)
+	return nil
+}
+
 type RC4CipherMaker struct{}
 
 func (m *RC4CipherMaker) NewStreamCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
@@ -71,38 +175,222 @@ func (m *AESCipherMaker) NewStreamCipher(key, iv []byte) (cipher.Stream, cipher.
 	}
 }
 
-var ciphers map[string]*CipherConfig
+// DuplexCipherMaker makes the ciphers whose key stream only depends on
+// key/iv (CTR modes, ChaCha20), the direction server -> client uses iv with
+// the top bit flipped so the two directions never share a key stream
+type DuplexCipherMaker struct {
+	NewStream func(key, iv []byte) (cipher.Stream, error)
+	// if not 0 a direction switches to a new iv every Rekey bytes, for the
+	// ciphers whose block counter runs out
+	Rekey uint64
+}
+
+// CHACHA20_REKEY is a quarter of the 2^32 blocks of the ChaCha20 counter,
+// x/crypto panics when the counter overflows
+const CHACHA20_REKEY = 1 << 36
+
+func (m *DuplexCipherMaker) newStream(key, iv []byte) (cipher.Stream, error) {
+	stream, err := m.NewStream(key, iv)
+	if err != nil || m.Rekey == 0 {
+		return stream, err
+	}
+	return &rekeyStream{maker: m, key: key, iv: iv, left: m.Rekey, stream: stream}, nil
+}
+
+// duplexIVs returns the iv of client -> server and the one of server ->
+// client with the top bit flipped
+func duplexIVs(iv []byte) ([]byte, []byte) {
+	down_iv := make([]byte, len(iv))
+	copy(down_iv, iv)
+	if len(down_iv) > 0 {
+		down_iv[0] ^= 0x80
+	}
+	return iv, down_iv
+}
+
+func (m *DuplexCipherMaker) streams(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
+	iv, down_iv := duplexIVs(iv)
+	up, err := m.newStream(key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+	down, err := m.newStream(key, down_iv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return up, down, nil
+}
+
+// rekeyStream starts segment i of a direction with i xored into the last 8
+// bytes of iv, the top bit of iv[0] that tells the directions apart is kept
+type rekeyStream struct {
+	maker   *DuplexCipherMaker
+	key     []byte
+	iv      []byte
+	segment uint64
+	left    uint64
+	stream  cipher.Stream
+}
+
+func (s *rekeyStream) XORKeyStream(dst, src []byte) {
+	for len(src) > 0 {
+		if s.left == 0 {
+			s.segment++
+			iv := make([]byte, len(s.iv))
+			copy(iv, s.iv)
+			var seg [8]byte
+			binary.BigEndian.PutUint64(seg[:], s.segment)
+			for i := range seg {
+				iv[len(iv)-8+i] ^= seg[i]
+			}
+			stream, err := s.maker.NewStream(s.key, iv)
+			if err != nil {
+				// the key/iv sizes were accepted by the first segment
+				panic(err)
+			}
+			s.stream, s.left = stream, s.maker.Rekey
+		}
+		n := len(src)
+		if uint64(n) > s.left {
+			n = int(s.left)
+		}
+		s.stream.XORKeyStream(dst[:n], src[:n])
+		dst, src = dst[n:], src[n:]
+		s.left -= uint64(n)
+	}
+}
+
+func (m *DuplexCipherMaker) NewStreamCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
+	return m.streams(key, iv)
+}
+
+func (m *DuplexCipherMaker) NewServerStreamCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
+	up, down, err := m.streams(key, iv)
+	return down, up, err
+}
+
+// AEADCipherMaker makes the AEAD ciphers, the pipe seals the data in records
+// instead of xoring a key stream, so it has no stream cipher
+type AEADCipherMaker struct {
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func (m *AEADCipherMaker) NewStreamCipher(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
+	return nil, nil, fmt.Errorf("an aead cipher has no stream cipher")
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newAESCTR(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+func newChaCha20(key, iv []byte) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(key, iv)
+}
+
+var (
+	ciphers_lock sync.RWMutex
+	ciphers      = make(map[string]*CipherConfig)
+)
+
+// RegisterCipher adds a cipher for GlobalEncryptMethod/LinkEncryptMethods,
+// it must be called before the clients and servers are made
+func RegisterCipher(name string, key_size, iv_size int, security CipherSecurity, maker CipherMaker) error {
+	if name == "" || strings.Contains(name, ",") {
+		return fmt.Errorf("invalid cipher name: %q", name)
+	}
+	if maker == nil {
+		return fmt.Errorf("cipher %s: nil maker", name)
+	}
+	ciphers_lock.Lock()
+	defer ciphers_lock.Unlock()
+	if _, ok := ciphers[name]; ok {
+		return fmt.Errorf("cipher %s already registered", name)
+	}
+	ciphers[name] = &CipherConfig{
+		Name:     name,
+		KeySize:  key_size,
+		IVSize:   iv_size,
+		Security: security,
+		maker:    maker}
+	return nil
+}
+
+func mustRegisterCipher(name string, key_size, iv_size int, security CipherSecurity, maker CipherMaker) {
+	if err := RegisterCipher(name, key_size, iv_size, security, maker); err != nil {
+		panic(err)
+	}
+}
 
 func init() {
-	ciphers = make(map[string]*CipherConfig)
-	ciphers["rc4"] = &CipherConfig{Name: "rc4", maker: new(RC4CipherMaker)}
-	ciphers["des"] = &CipherConfig{
-		Name:    "des",
-		KeySize: 8,
-		IVSize:  des.BlockSize,
-		maker:   &DESCipherMaker{is3des: false}}
-	ciphers["3des-192"] = &CipherConfig{
-		Name:    "3des-192",
-		KeySize: 24,
-		IVSize:  des.BlockSize,
-		maker:   &DESCipherMaker{is3des: true}}
-	ciphers["aes-128"] = &CipherConfig{
-		Name:    "aes-128",
-		KeySize: 16,
-		IVSize:  aes.BlockSize,
-		maker:   new(AESCipherMaker)}
-	ciphers["aes-192"] = &CipherConfig{
-		Name:    "aes-192",
-		KeySize: 24,
-		IVSize:  aes.BlockSize,
-		maker:   new(AESCipherMaker)}
-	ciphers["aes-256"] = &CipherConfig{
-		Name:    "aes-256",
-		KeySize: 32,
-		IVSize:  aes.BlockSize,
-		maker:   new(AESCipherMaker)}
+	mustRegisterCipher("rc4", 16, 0, CIPHER_WEAK, new(RC4CipherMaker))
+	mustRegisterCipher("des", 8, des.BlockSize, CIPHER_WEAK, &DESCipherMaker{is3des: false})
+	mustRegisterCipher("3des-192", 24, des.BlockSize, CIPHER_STANDARD, &DESCipherMaker{is3des: true})
+	mustRegisterCipher("aes-128", 16, aes.BlockSize, CIPHER_STANDARD, new(AESCipherMaker))
+	mustRegisterCipher("aes-192", 24, aes.BlockSize, CIPHER_STANDARD, new(AESCipherMaker))
+	mustRegisterCipher("aes-256", 32, aes.BlockSize, CIPHER_STANDARD, new(AESCipherMaker))
+	gcm := &AEADCipherMaker{NewAEAD: newAESGCM}
+	mustRegisterCipher("aes-128-gcm", 16, 12, CIPHER_STRONG, gcm)
+	mustRegisterCipher("aes-256-gcm", 32, 12, CIPHER_STRONG, gcm)
+	mustRegisterCipher("chacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.NonceSize,
+		CIPHER_STRONG, &AEADCipherMaker{NewAEAD: chacha20poly1305.New})
+	ctr := &DuplexCipherMaker{NewStream: newAESCTR}
+	mustRegisterCipher("aes-128-ctr", 16, aes.BlockSize, CIPHER_STRONG, ctr)
+	mustRegisterCipher("aes-192-ctr", 24, aes.BlockSize, CIPHER_STRONG, ctr)
+	mustRegisterCipher("aes-256-ctr", 32, aes.BlockSize, CIPHER_STRONG, ctr)
+	mustRegisterCipher("chacha20", chacha20.KeySize, chacha20.NonceSize, CIPHER_STRONG,
+		&DuplexCipherMaker{NewStream: newChaCha20, Rekey: CHACHA20_REKEY})
+}
+
+// hasAESHardware reports whether AES runs in hardware, ChaCha20 is faster
+// without it
+func hasAESHardware() bool {
+	return cpu.X86.HasAES || cpu.ARM64.HasAES || cpu.S390X.HasAES
+}
+
+// defaultLinkEncryptMethods prefers the AEAD cipher that is fast on this
+// CPU, then the unauthenticated and older ones for old peers
+func defaultLinkEncryptMethods() []string {
+	strong := []string{"chacha20-poly1305", "aes-256-gcm", "aes-128-gcm", "chacha20", "aes-256-ctr", "aes-128-ctr"}
+	if hasAESHardware() {
+		strong = []string{"aes-256-gcm", "aes-128-gcm", "chacha20-poly1305", "aes-256-ctr", "aes-128-ctr", "chacha20"}
+	}
+	return append(strong, "aes-256", "aes-192", "aes-128", "3des-192")
 }
 
 func GetCipherConfig(name string) *CipherConfig {
+	ciphers_lock.RLock()
+	defer ciphers_lock.RUnlock()
 	return ciphers[name]
 }
+
+// CheckCiphers checks that the ciphers of names exist and are not below
+// minimum (a MinimumSecurity)
+func CheckCiphers(names []string, minimum string) error {
+	min_sec, err := ParseCipherSecurity(minimum)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		cfg := GetCipherConfig(name)
+		if cfg == nil {
+			return fmt.Errorf("no such cipher: %s", name)
+		}
+		if cfg.Security < min_sec {
+			return fmt.Errorf("cipher %s is %s, below MinimumSecurity %s; remove it or set MinimumSecurity: %s",
+				name, cfg.Security, min_sec, cfg.Security)
+		}
+	}
+	return nil
+}
@@ -20,6 +20,9 @@ func LoadGlobalCipherConfig(name string, passwd []byte) (*GlobalCipherConfig, er
 	if cfg == nil {
 		return nil, fmt.Errorf("no such cipher: %s", name)
 	}
+	if cfg.perSessionKey() {
+		return nil, fmt.Errorf("%s can't be the global cipher, its key stream would repeat on every connection", name)
+	}
 
 	key, iv := MakeCryptoKeyIV(passwd, cfg.KeySize, cfg.IVSize)
 	return &GlobalCipherConfig{
@@ -29,6 +32,15 @@ func LoadGlobalCipherConfig(name string, passwd []byte) (*GlobalCipherConfig, er
 	}, nil
 }
 
+// CheckGlobalCipher is CheckCiphers of the global cipher, its key is fixed by
+// the password anyway so a strong minimum only asks for a standard cipher
+func CheckGlobalCipher(name, minimum string) error {
+	if minimum == CIPHER_STRONG.String() {
+		minimum = CIPHER_STANDARD.String()
+	}
+	return CheckCiphers([]string{name}, minimum)
+}
+
 func (cfg *GlobalCipherConfig) NewCipher() (cipher.Stream, cipher.Stream, error) {
 	return cfg.Config.NewCipher(cfg.Key, cfg.IV)
 }
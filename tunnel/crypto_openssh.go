@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+const opensshMagic = "openssh-key-v1\x00"
+
+// sshReader reads the string/uint32/mpint fields of the SSH wire format, the
+// first error sticks
+type sshReader struct {
+	buf []byte
+	err error
+}
+
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 4 {
+		r.err = fmt.Errorf("openssh key truncated")
+		return 0
+	}
+	n := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return n
+}
+
+func (r *sshReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint32(len(r.buf)) < n {
+		r.err = fmt.Errorf("openssh key truncated")
+		return nil
+	}
+	bs := r.buf[:n]
+	r.buf = r.buf[n:]
+	return bs
+}
+
+func (r *sshReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *sshReader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
+
+// parseOpenSSHPrivateKey parses the body of an unencrypted
+// "OPENSSH PRIVATE KEY" PEM block of ssh-keygen
+func parseOpenSSHPrivateKey(data []byte) (interface{}, error) {
+	if !bytes.HasPrefix(data, []byte(opensshMagic)) {
+		return nil, fmt.Errorf("invalid openssh key magic")
+	}
+	r := &sshReader{buf: data[len(opensshMagic):]}
+	cipher_name, kdf_name := r.string(), r.string()
+	r.bytes() // kdf options
+	n_keys := r.uint32()
+	r.bytes() // public key
+	priv := &sshReader{buf: r.bytes()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if cipher_name != "none" || kdf_name != "none" {
+		return nil, fmt.Errorf("encrypted openssh keys are not supported, remove the passphrase with ssh-keygen -p")
+	}
+	if n_keys != 1 {
+		return nil, fmt.Errorf("openssh key file has %d keys", n_keys)
+	}
+
+	if priv.uint32() != priv.uint32() {
+		return nil, fmt.Errorf("openssh key check bytes not match")
+	}
+	var key interface{}
+	switch key_type := priv.string(); key_type {
+	case "ssh-rsa":
+		n, e, d := priv.mpint(), priv.mpint(), priv.mpint()
+		priv.mpint() // iqmp
+		p, q := priv.mpint(), priv.mpint()
+		if priv.err != nil {
+			return nil, priv.err
+		}
+		if !e.IsInt64() {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		rsa_key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q}}
+		if err := rsa_key.Validate(); err != nil {
+			return nil, err
+		}
+		rsa_key.Precompute()
+		key = rsa_key
+	case "ssh-ed25519":
+		priv.bytes() // public key
+		seed := priv.bytes()
+		if priv.err != nil {
+			return nil, priv.err
+		}
+		if len(seed) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key size %d", len(seed))
+		}
+		key = ed25519.NewKeyFromSeed(seed[:ed25519.SeedSize])
+	case "ecdsa-sha2-nistp256":
+		priv.string() // curve name
+		point, d := priv.bytes(), priv.mpint()
+		if priv.err != nil {
+			return nil, priv.err
+		}
+		if d.BitLen() > 256 {
+			return nil, fmt.Errorf("invalid ecdsa key")
+		}
+		// crypto/ecdh checks the scalar and computes the uncompressed point
+		ecdh_key, err := ecdh.P256().NewPrivateKey(d.FillBytes(make([]byte, 32)))
+		if err != nil {
+			return nil, err
+		}
+		pub := ecdh_key.PublicKey().Bytes()
+		if !bytes.Equal(pub, point) {
+			return nil, fmt.Errorf("ecdsa public key not match")
+		}
+		key = &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(pub[1:33]),
+				Y:     new(big.Int).SetBytes(pub[33:65])},
+			D: d}
+	default:
+		return nil, fmt.Errorf("unsupported openssh key type %s", key_type)
+	}
+	return key, nil
+}
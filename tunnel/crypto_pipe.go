@@ -3,15 +3,25 @@ package tunnel
 import (
 	"bufio"
 	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"sync"
 )
 
+// AEAD_RECORD_SIZE is the max plaintext size of an AEAD record
+const AEAD_RECORD_SIZE = 16 * 1024
+
 type StreamPipe struct {
 	rw     io.ReadWriteCloser
 	buf_r  *bufio.Reader
 	enc    cipher.Stream
 	dec    cipher.Stream
+	seal   *aeadState
+	open   *aeadState
+	r_data []byte
 	closed bool
+	lock   sync.Mutex
 }
 
 func NewStreamPipe(rw io.ReadWriteCloser) *StreamPipe {
@@ -22,9 +32,21 @@ func NewStreamPipe(rw io.ReadWriteCloser) *StreamPipe {
 
 func (pipe *StreamPipe) SwitchCipher(enc, dec cipher.Stream) {
 	pipe.enc, pipe.dec = enc, dec
+	pipe.seal, pipe.open = nil, nil
+}
+
+// SwitchAEAD makes the pipe send records sealed by seal with nonces from
+// seal_iv and read records opened by open with nonces from open_iv
+func (pipe *StreamPipe) SwitchAEAD(seal, open cipher.AEAD, seal_iv, open_iv []byte) {
+	pipe.enc, pipe.dec = nil, nil
+	pipe.seal = &aeadState{aead: seal, iv: seal_iv}
+	pipe.open = &aeadState{aead: open, iv: open_iv}
 }
 
 func (pipe *StreamPipe) Read(bs []byte) (int, error) {
+	if pipe.open != nil {
+		return pipe.readRecord(bs)
+	}
 	if n, err := pipe.buf_r.Read(bs); err == nil {
 		if pipe.dec != nil {
 			pipe.dec.XORKeyStream(bs, bs[:n])
@@ -37,6 +59,9 @@ func (pipe *StreamPipe) Read(bs []byte) (int, error) {
 
 func (pipe *StreamPipe) Write(bs []byte) (int, error) {
 	//fmt.Printf("send: %v\n", bs)
+	if pipe.seal != nil {
+		return pipe.writeRecords(bs)
+	}
 	if pipe.enc != nil {
 		pipe.enc.XORKeyStream(bs, bs)
 	}
@@ -44,6 +69,8 @@ func (pipe *StreamPipe) Write(bs []byte) (int, error) {
 }
 
 func (pipe *StreamPipe) Close() error {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
 	if !pipe.closed {
 		if err := pipe.rw.Close(); err != nil {
 			return err
@@ -52,3 +79,74 @@ func (pipe *StreamPipe) Close() error {
 	}
 	return nil
 }
+
+// aeadState is a direction of an AEAD pipe, the nonce of a seal is iv with
+// the count of the previous seals xored into its last 8 bytes
+type aeadState struct {
+	aead  cipher.AEAD
+	iv    []byte
+	count uint64
+}
+
+func (s *aeadState) nonce() []byte {
+	nonce := make([]byte, len(s.iv))
+	copy(nonce, s.iv)
+	var count [8]byte
+	binary.BigEndian.PutUint64(count[:], s.count)
+	for i := range count {
+		nonce[len(nonce)-8+i] ^= count[i]
+	}
+	s.count++
+	return nonce
+}
+
+// writeRecords sends bs in records of a sealed size[2] and the sealed data
+func (pipe *StreamPipe) writeRecords(bs []byte) (int, error) {
+	overhead := pipe.seal.aead.Overhead()
+	records := (len(bs) + AEAD_RECORD_SIZE - 1) / AEAD_RECORD_SIZE
+	out := make([]byte, 0, len(bs)+records*(2+2*overhead))
+	for data := bs; len(data) > 0; {
+		n := len(data)
+		if n > AEAD_RECORD_SIZE {
+			n = AEAD_RECORD_SIZE
+		}
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(n))
+		out = pipe.seal.aead.Seal(out, pipe.seal.nonce(), size[:], nil)
+		out = pipe.seal.aead.Seal(out, pipe.seal.nonce(), data[:n], nil)
+		data = data[n:]
+	}
+	if _, err := pipe.rw.Write(out); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+// readRecord returns the data left of the last record or opens the next one
+func (pipe *StreamPipe) readRecord(bs []byte) (int, error) {
+	if len(pipe.r_data) == 0 {
+		overhead := pipe.open.aead.Overhead()
+		buf := make([]byte, 2+overhead, AEAD_RECORD_SIZE+overhead)
+		if _, err := io.ReadFull(pipe.buf_r, buf); err != nil {
+			return 0, err
+		}
+		size, err := pipe.open.aead.Open(buf[:0], pipe.open.nonce(), buf, nil)
+		if err != nil {
+			return 0, fmt.Errorf("open record size fail: %v", err)
+		}
+		n := int(binary.BigEndian.Uint16(size))
+		if n == 0 || n > AEAD_RECORD_SIZE {
+			return 0, fmt.Errorf("invalid record size %d", n)
+		}
+		buf = buf[:n+overhead]
+		if _, err := io.ReadFull(pipe.buf_r, buf); err != nil {
+			return 0, err
+		}
+		if pipe.r_data, err = pipe.open.aead.Open(buf[:0], pipe.open.nonce(), buf, nil); err != nil {
+			return 0, fmt.Errorf("open record fail: %v", err)
+		}
+	}
+	n := copy(bs, pipe.r_data)
+	pipe.r_data = pipe.r_data[n:]
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// KeyRotation is the endorsement of a new server key by the previous one,
+// the clients that pinned the previous key accept the new one until Expire
+type KeyRotation struct {
+	// PKIX DER of the previous key
+	OldPublicKey []byte
+	Expire       time.Time
+	// signature of the new key DER and expire[8] by the previous key
+	Signature []byte
+}
+
+// NewKeyRotation makes old endorse new_pub until expire
+func NewKeyRotation(old crypto.Signer, new_pub crypto.PublicKey, expire time.Time) (*KeyRotation, error) {
+	old_der, err := x509.MarshalPKIXPublicKey(old.Public())
+	if err != nil {
+		return nil, err
+	}
+	new_der, err := x509.MarshalPKIXPublicKey(new_pub)
+	if err != nil {
+		return nil, err
+	}
+	r := &KeyRotation{OldPublicKey: old_der, Expire: time.Unix(expire.Unix(), 0)}
+	if r.Signature, err = signData(old, r.signedData(new_der)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *KeyRotation) signedData(new_der []byte) []byte {
+	data := make([]byte, len(new_der)+8)
+	copy(data, new_der)
+	binary.BigEndian.PutUint64(data[len(new_der):], uint64(r.Expire.Unix()))
+	return data
+}
+
+// Verify checks that the previous key endorsed the key of new_der, expired
+// or not
+func (r *KeyRotation) Verify(new_der []byte) error {
+	old_pub, err := x509.ParsePKIXPublicKey(r.OldPublicKey)
+	if err != nil {
+		return err
+	}
+	return verifyData(old_pub, r.signedData(new_der), r.Signature)
+}
+
+// Marshal encodes r as expire[8] + old_size[2] + old_pub + signature
+func (r *KeyRotation) Marshal() []byte {
+	bs := make([]byte, 10+len(r.OldPublicKey)+len(r.Signature))
+	binary.BigEndian.PutUint64(bs, uint64(r.Expire.Unix()))
+	WriteN2(bs, 8, uint16(len(r.OldPublicKey)))
+	copy(bs[10:], r.OldPublicKey)
+	copy(bs[10+len(r.OldPublicKey):], r.Signature)
+	return bs
+}
+
+func ParseKeyRotation(bs []byte) (*KeyRotation, error) {
+	if len(bs) < 10 {
+		return nil, fmt.Errorf("key rotation too short")
+	}
+	old_size := int(ReadN2(bs, 8))
+	if len(bs) <= 10+old_size {
+		return nil, fmt.Errorf("invalid key rotation size %d", old_size)
+	}
+	return &KeyRotation{
+		OldPublicKey: bs[10 : 10+old_size],
+		Expire:       time.Unix(int64(binary.BigEndian.Uint64(bs)), 0),
+		Signature:    bs[10+old_size:]}, nil
+}
+
+// SaveKeyRotation writes r to path, the server loads it from <KeyPath>.rotation
+func SaveKeyRotation(r *KeyRotation, path string) error {
+	return writePEMData("KEY ROTATION", r.Marshal(), path, 0644)
+}
+
+func LoadKeyRotation(path string) (*KeyRotation, error) {
+	block, err := readPEMData(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyRotation(block.Bytes)
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	old_key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation, err := NewKeyRotation(old_key, &new_key.PublicKey, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseKeyRotation(rotation.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_der, _ := x509.MarshalPKIXPublicKey(&new_key.PublicKey)
+	old_der, _ := x509.MarshalPKIXPublicKey(&old_key.PublicKey)
+	if err := parsed.Verify(new_der); err != nil {
+		t.Error("verify", err)
+	}
+	if err := parsed.Verify(old_der); err == nil {
+		t.Error("endorsed the wrong key")
+	}
+
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pin := filepath.Join(dir, "old.pub")
+	if err := SavePublicKey(&old_key.PublicKey, pin); err != nil {
+		t.Fatal(err)
+	}
+
+	// a client that pinned the old key logs in until the rotation expires
+	expired, _ := NewKeyRotation(old_key, &new_key.PublicKey, time.Now().Add(-time.Second))
+	for _, c := range []struct {
+		rotation *KeyRotation
+		ok       bool
+	}{{rotation, true}, {expired, false}, {nil, false}} {
+		ser, cleanup := newTestServer(t, &ServerOptions{PrivateKey: new_key, KeyRotation: c.rotation})
+		cfg := newTestClientConfig(ser.listenser.Addr().String())
+		cfg.ServerPublicKeyPath = pin
+		cli, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Init(); (err == nil) != c.ok {
+			t.Error("rotation", c.rotation != nil, "login", err)
+		}
+		cli.Close()
+		cleanup()
+	}
+}
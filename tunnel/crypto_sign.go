@@ -1,9 +1,15 @@
 package tunnel
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io"
@@ -14,7 +20,7 @@ func writePEMData(block_type string, der []byte, path string, mode os.FileMode)
 	var block pem.Block
 	block.Type = block_type
 	block.Bytes = der
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, mode)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
@@ -33,18 +39,150 @@ func GenerateRSAKey(bits int, path string) (*rsa.PrivateKey, error) {
 		path, 0600); err != nil {
 		return nil, err
 	}
+	if err := SavePublicKey(&pri.PublicKey, path+".pub"); err != nil {
+		return nil, err
+	}
+	return pri, nil
+}
 
-	if bs, err := x509.MarshalPKIXPublicKey(&pri.PublicKey); err == nil {
-		if err := writePEMData("RSA PUBLIC KEY", bs, path+".pub", 0644); err != nil {
-			return nil, err
-		}
-	} else {
+// GenerateEd25519Key writes a PKCS#8 private key to path and its public key
+// to path.pub
+func GenerateEd25519Key(path string) (ed25519.PrivateKey, error) {
+	_, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := savePKCS8Key(pri, path); err != nil {
 		return nil, err
 	}
+	return pri, nil
+}
 
+// GenerateECDSAKey writes a P-256 PKCS#8 private key to path and its public
+// key to path.pub
+func GenerateECDSAKey(path string) (*ecdsa.PrivateKey, error) {
+	pri, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := savePKCS8Key(pri, path); err != nil {
+		return nil, err
+	}
 	return pri, nil
 }
 
+func savePKCS8Key(pri crypto.Signer, path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(pri)
+	if err != nil {
+		return err
+	}
+	if err := writePEMData("PRIVATE KEY", der, path, 0600); err != nil {
+		return err
+	}
+	return SavePublicKey(pri.Public(), path+".pub")
+}
+
+// GenerateKey generates a key of key_type, "rsa" of bits, "ed25519" or
+// "ecdsa" (P-256)
+func GenerateKey(key_type string, bits int, path string) (crypto.Signer, error) {
+	switch key_type {
+	case "rsa":
+		return GenerateRSAKey(bits, path)
+	case "ed25519":
+		return GenerateEd25519Key(path)
+	case "ecdsa":
+		return GenerateECDSAKey(path)
+	}
+	return nil, fmt.Errorf("unknown key type: %s (rsa, ed25519 or ecdsa)", key_type)
+}
+
+// KeyType returns the key type name of GenerateKey, empty if pub is not a
+// supported server key
+func KeyType(pub crypto.PublicKey) string {
+	switch keyTypeOf(pub) {
+	case KEY_TYPE_RSA:
+		return "rsa"
+	case KEY_TYPE_ED25519:
+		return "ed25519"
+	case KEY_TYPE_ECDSA_P256:
+		return "ecdsa"
+	}
+	return ""
+}
+
+// keyTypeOf returns the KEY_TYPE_* of pub, 0 if not supported
+func keyTypeOf(pub crypto.PublicKey) byte {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return KEY_TYPE_RSA
+	case ed25519.PublicKey:
+		return KEY_TYPE_ED25519
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return KEY_TYPE_ECDSA_P256
+		}
+	}
+	return 0
+}
+
+// SavePublicKey writes pub to path in the format of ServerPublicKeyPath
+func SavePublicKey(pub crypto.PublicKey, path string) error {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	block_type := "PUBLIC KEY"
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		block_type = "RSA PUBLIC KEY"
+	}
+	return writePEMData(block_type, der, path, 0644)
+}
+
+// KeyFingerprint returns the SHA-256 of the PKIX DER of pub like
+// "SHA256:<base64>"
+func KeyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return derFingerprint(der), nil
+}
+
+func derFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// signData signs the SHA-256 of data with an RSA (PKCS#1 v1.5) or ECDSA
+// (ASN.1) key, or data itself with an Ed25519 key
+func signData(signer crypto.Signer, data []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	dgst := sha256.Sum256(data)
+	return signer.Sign(rand.Reader, dgst[:], crypto.SHA256)
+}
+
+func verifyData(pub crypto.PublicKey, data, sig []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		dgst := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, dgst[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, sig) {
+			return fmt.Errorf("ed25519 verification error")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		dgst := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(key, dgst[:], sig) {
+			return fmt.Errorf("ecdsa verification error")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key %T", pub)
+}
+
 func readPEMData(path string) (*pem.Block, error) {
 	if f, err := os.Open(path); err == nil {
 		defer f.Close()
@@ -72,13 +210,62 @@ func readPEMData(path string) (*pem.Block, error) {
 	}
 }
 
+// Deprecated: LoadPrivateKey loads the RSA keys and the other key types
 func LoadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	key, err := LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if rsa_key, ok := key.(*rsa.PrivateKey); ok {
+		return rsa_key, nil
+	}
+	return nil, fmt.Errorf("%s is not an RSA key", path)
+}
+
+// LoadPrivateKey loads an RSA, Ed25519 or ECDSA P-256 server key in PKCS#1,
+// SEC 1, PKCS#8 or unencrypted OpenSSH format
+func LoadPrivateKey(path string) (crypto.Signer, error) {
 	block, err := readPEMData(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		key, err = parseOpenSSHPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || keyTypeOf(signer.Public()) == 0 {
+		return nil, fmt.Errorf("%s: unsupported key %T", path, key)
+	}
+	return signer, nil
+}
+
+// LoadPublicKey loads a PKIX public key, or the public key of a private key
+// file
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEMData(path)
+	if err != nil {
+		return nil, err
+	}
+	if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return pub, nil
+	}
+	pri, err := LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return pri.Public(), nil
 }
 
 func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
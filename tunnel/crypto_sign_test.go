@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, key_type := range []string{"rsa", "ed25519", "ecdsa"} {
+		path := filepath.Join(dir, key_type)
+		key, err := GenerateKey(key_type, 1024, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadPrivateKey(path)
+		if err != nil || KeyType(loaded.Public()) != key_type {
+			t.Fatal(key_type, "load", err)
+		}
+
+		ser, cleanup := newTestServer(t, &ServerOptions{PrivateKey: key})
+		cfg := newTestClientConfig(ser.listenser.Addr().String())
+		cfg.ServerPublicKeyPath = path + ".pub"
+		cli, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Init(); err != nil {
+			t.Error(key_type, "login", err)
+		}
+		cli.Close()
+		cleanup()
+	}
+}
+
+func TestLoadOpenSSHKey(t *testing.T) {
+	ssh_keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("no ssh-keygen")
+	}
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range [][]string{{"rsa", "-t", "rsa", "-b", "1024"}, {"ed25519", "-t", "ed25519"},
+		{"ecdsa", "-t", "ecdsa", "-b", "256"}} {
+		path := filepath.Join(dir, c[0])
+		args := append([]string{"-q", "-N", "", "-f", path}, c[1:]...)
+		if out, err := exec.Command(ssh_keygen, args...).CombinedOutput(); err != nil {
+			t.Fatal(c[0], err, string(out))
+		}
+		key, err := LoadPrivateKey(path)
+		if err != nil {
+			t.Error(c[0], err)
+			continue
+		}
+		if KeyType(key.Public()) != c[0] {
+			t.Error(c[0], "loaded", KeyType(key.Public()))
+		}
+		der, _ := x509.MarshalPKIXPublicKey(key.Public())
+		sig, err := signData(key, der)
+		if err == nil {
+			err = verifyData(key.Public(), der, sig)
+		}
+		if err != nil {
+			t.Error(c[0], "sign", err)
+		}
+	}
+}
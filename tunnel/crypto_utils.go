@@ -1,7 +1,16 @@
 package tunnel
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+	"strings"
 )
 
 func MakeCryptoKeyIV(password []byte, key_size, iv_size int) ([]byte, []byte) {
@@ -29,3 +38,56 @@ func MakeCryptoKeyIV(password []byte, key_size, iv_size int) ([]byte, []byte) {
 	iv := buf[key_size:]
 	return key, iv
 }
+
+const passwordHashIter = 100000
+
+// HashPassword hashes passwd for the users file as
+// pbkdf2-sha256$<iterations>$<salt>$<hash> in raw base64
+func HashPassword(passwd string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(passwd), salt, passwordHashIter, 32, sha256.New)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIter,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPasswordHash reports whether passwd matches a hash of HashPassword
+func CheckPasswordHash(hash, passwd string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	key := pbkdf2.Key([]byte(passwd), salt, iter, len(expected), sha256.New)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// reuseMAC is the HMAC-SHA256 of label and data by the key of a session,
+// the labels keep the proof of the server apart from the link key
+func reuseMAC(key []byte, label string, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, bs := range data {
+		mac.Write(bs)
+	}
+	return mac.Sum(nil)
+}
+
+// reuseKeyIV makes the link key and iv of a reused session from the random
+// data of the client and the server
+func reuseKeyIV(key, cli_rand, ser_rand []byte, cfg *CipherConfig) ([]byte, []byte) {
+	return MakeCryptoKeyIV(reuseMAC(key, "breaksocks reuse key", cli_rand, ser_rand), cfg.KeySize, cfg.IVSize)
+}
@@ -1,23 +1,74 @@
 package tunnel
 
+import (
+	"fmt"
+	"net"
+)
+
 const (
 	B_TRUE  byte = 1
 	B_FALSE byte = 0
 
 	PROTO_MAGIC   = 'P'
-	PROTO_VERSION = 1
+	PROTO_VERSION = 5
+	// since this version the server answers every new conn with
+	// PACKET_CONN_OK or PACKET_CONN_FAIL
+	PROTO_VERSION_CONN_REPLY = 2
+	// since this version a new conn can carry the sub identity
+	PROTO_VERSION_SUB_IDENTITY = 3
+	// since this version a new conn can be UDP
+	PROTO_VERSION_UDP = 4
+	// since this version a session can be reused with a new link key
+	PROTO_VERSION_REUSE = 5
+
+	// startup version of a new session request, sent in the random_size
+	// field; since this version the Startup Response can carry extensions
+	STARTUP_VERSION_EXT = 1
+	// flag of pub_size in a Startup Response with extensions
+	STARTUP_EXT_FLAG = 0x8000
+	// extension types of the Startup Response
+	STARTUP_EXT_KEY_ROTATION = 1
+	STARTUP_EXT_KEY_TYPE     = 2
+	STARTUP_EXT_CIPHER_PREF  = 3
+
+	// server key types of STARTUP_EXT_KEY_TYPE
+	KEY_TYPE_RSA        = 1
+	KEY_TYPE_ED25519    = 2
+	KEY_TYPE_ECDSA_P256 = 3
+
+	// who picks the link cipher of STARTUP_EXT_CIPHER_PREF
+	CIPHER_PREF_SERVER = 0
+	CIPHER_PREF_CLIENT = 1
 
 	PACKET_NEW_CONN   = 1
 	PACKET_PROXY      = 2
 	PACKET_CLOSE_CONN = 3
+	PACKET_CONN_FAIL  = 4
+	PACKET_CONN_OK    = 5
+
+	// conn fail codes, same values as the SOCKS5 replies
+	CONN_ERR_GENERAL             = 1
+	CONN_ERR_NOT_ALLOWED         = 2
+	CONN_ERR_NETWORK_UNREACHABLE = 3
+	CONN_ERR_HOST_UNREACHABLE    = 4
+	CONN_ERR_REFUSED             = 5
+	CONN_ERR_TTL_EXPIRED         = 6
 
 	PROTO_ADDR_IP     byte = 1
 	PROTO_ADDR_DOMAIN byte = 2
+	// flag of conn_type, every PACKET_PROXY of the conn is a datagram
+	PROTO_CONN_UDP byte = 0x10
+	// max payload of a PACKET_PROXY
+	MAX_PROXY_DATA = 2048 - 8
 
 	REUSE_SUCCESS                    = 0
 	REUSE_FAIL_HMAC_FAIL             = 1
 	REUSE_FAIL_SYS_ERR               = 2
+	REUSE_FAIL_NO_USER               = 3
+	REUSE_FAIL_NO_SESSION            = 4
 	REUSE_FAIL_START_CIPHER_EXCHANGE = 0x10
+	// size of the random data of a reuse request and response
+	REUSE_RANDOM_SIZE = 32
 )
 
 type ReuseSession struct {
@@ -47,3 +98,69 @@ type LoginResponse struct {
 	LoginOk       bool
 	SessionId     string
 }
+
+func makeClosePacket(conn_id uint32) []byte {
+	bs := make([]byte, 8)
+	bs[0] = PROTO_MAGIC
+	bs[1] = PACKET_CLOSE_CONN
+	WriteN2(bs, 2, 0)
+	WriteN4(bs, 4, conn_id)
+	return bs
+}
+
+func makeConnFailPacket(conn_id uint32, code uint16, msg string) []byte {
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+	bs := make([]byte, 12+len(msg))
+	bs[0] = PROTO_MAGIC
+	bs[1] = PACKET_CONN_FAIL
+	WriteN2(bs, 2, uint16(4+len(msg)))
+	WriteN4(bs, 4, conn_id)
+	WriteN2(bs, 8, code)
+	WriteN2(bs, 10, uint16(len(msg)))
+	copy(bs[12:], msg)
+	return bs
+}
+
+func makeConnOkPacket(conn_id uint32, bnd, rmt *net.TCPAddr) []byte {
+	bnd_ip, rmt_ip := addrIPBytes(bnd.IP), addrIPBytes(rmt.IP)
+	bs := make([]byte, 14+len(bnd_ip)+len(rmt_ip))
+	bs[0] = PROTO_MAGIC
+	bs[1] = PACKET_CONN_OK
+	WriteN2(bs, 2, uint16(6+len(bnd_ip)+len(rmt_ip)))
+	WriteN4(bs, 4, conn_id)
+	cur := 8
+	bs[cur] = byte(len(bnd_ip))
+	WriteN2(bs, cur+1, uint16(bnd.Port))
+	cur += 3
+	cur += copy(bs[cur:], bnd_ip)
+	bs[cur] = byte(len(rmt_ip))
+	WriteN2(bs, cur+1, uint16(rmt.Port))
+	cur += 3
+	copy(bs[cur:], rmt_ip)
+	return bs
+}
+
+// parseConnOk returns the bound and the remote address of a PACKET_CONN_OK body
+func parseConnOk(data []byte) (*net.TCPAddr, *net.TCPAddr, error) {
+	addrs := make([]*net.TCPAddr, 2)
+	cur := 0
+	for i := range addrs {
+		if len(data) < cur+3 || len(data) < cur+3+int(data[cur]) {
+			return nil, nil, fmt.Errorf("invalid conn ok packet")
+		}
+		size := int(data[cur])
+		addrs[i] = &net.TCPAddr{Port: int(ReadN2(data, cur+1))}
+		addrs[i].IP = append(net.IP(nil), data[cur+3:cur+3+size]...)
+		cur += 3 + size
+	}
+	return addrs[0], addrs[1], nil
+}
+
+func addrIPBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
@@ -0,0 +1,329 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type RouteAction int
+
+const (
+	ROUTE_TUNNEL RouteAction = iota
+	ROUTE_DIRECT
+	ROUTE_REJECT
+)
+
+func (a RouteAction) String() string {
+	switch a {
+	case ROUTE_TUNNEL:
+		return "TUNNEL"
+	case ROUTE_DIRECT:
+		return "DIRECT"
+	case ROUTE_REJECT:
+		return "REJECT"
+	}
+	return fmt.Sprintf("RouteAction(%d)", int(a))
+}
+
+func ParseRouteAction(s string) (RouteAction, error) {
+	switch strings.ToLower(s) {
+	case "tunnel", "proxy":
+		return ROUTE_TUNNEL, nil
+	case "direct":
+		return ROUTE_DIRECT, nil
+	case "reject", "block":
+		return ROUTE_REJECT, nil
+	}
+	return ROUTE_TUNNEL, fmt.Errorf("no such route action: %s", s)
+}
+
+// RouteRule matches a destination if any of the domain/CIDR conditions
+// matches and its port is in Ports. A rule without domain/CIDR conditions
+// matches all hosts, a rule without Ports matches all ports. CIDR conditions
+// only match IP destinations, domains are never resolved locally.
+type RouteRule struct {
+	DomainSuffix  []string
+	DomainKeyword []string
+	DomainRegex   []string
+	CIDR          []string
+	// files with a CIDR per line, like chnroute.txt
+	CIDRFile []string
+	// "443" or "8000-9000"
+	Ports  []string
+	Action string
+}
+
+type routeRule struct {
+	idx      int
+	suffixes []string
+	keywords []string
+	regexps  []*regexp.Regexp
+	cidrs    *cidrSet
+	ports    [][2]int
+	action   RouteAction
+}
+
+type Router struct {
+	rules          []*routeRule
+	default_action RouteAction
+}
+
+func NewRouter(rules []RouteRule, default_action string) (*Router, error) {
+	r := &Router{default_action: ROUTE_TUNNEL}
+	var err error
+	if default_action != "" {
+		if r.default_action, err = ParseRouteAction(default_action); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, rule := range rules {
+		rr, err := newRouteRule(i, &rule)
+		if err != nil {
+			return nil, fmt.Errorf("route rule %d: %s", i, err.Error())
+		}
+		r.rules = append(r.rules, rr)
+	}
+	return r, nil
+}
+
+func newRouteRule(idx int, rule *RouteRule) (*routeRule, error) {
+	rr := &routeRule{idx: idx, cidrs: new(cidrSet)}
+	var err error
+	if rr.action, err = ParseRouteAction(rule.Action); err != nil {
+		return nil, err
+	}
+
+	for _, suffix := range rule.DomainSuffix {
+		rr.suffixes = append(rr.suffixes, normalizeDomain(suffix))
+	}
+	for _, kw := range rule.DomainKeyword {
+		rr.keywords = append(rr.keywords, strings.ToLower(kw))
+	}
+	for _, expr := range rule.DomainRegex {
+		if re, err := regexp.Compile(expr); err == nil {
+			rr.regexps = append(rr.regexps, re)
+		} else {
+			return nil, err
+		}
+	}
+	for _, cidr := range rule.CIDR {
+		if err := rr.cidrs.Add(cidr); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range rule.CIDRFile {
+		if err := rr.cidrs.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	rr.cidrs.build()
+
+	for _, p := range rule.Ports {
+		var lo, hi int
+		if idx := strings.IndexByte(p, '-'); idx >= 0 {
+			lo, err = strconv.Atoi(strings.TrimSpace(p[:idx]))
+			if err == nil {
+				hi, err = strconv.Atoi(strings.TrimSpace(p[idx+1:]))
+			}
+		} else {
+			lo, err = strconv.Atoi(strings.TrimSpace(p))
+			hi = lo
+		}
+		if err != nil || lo < 0 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("invalid port: %s", p)
+		}
+		rr.ports = append(rr.ports, [2]int{lo, hi})
+	}
+	return rr, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// Route returns the action for host:port and a description of the matched
+// rule. host is a domain or an IP.
+func (r *Router) Route(host string, port int) (RouteAction, string) {
+	ip := net.ParseIP(host)
+	domain := ""
+	if ip == nil {
+		domain = normalizeDomain(host)
+	}
+
+	for _, rule := range r.rules {
+		if reason, ok := rule.match(domain, ip, port); ok {
+			return rule.action, fmt.Sprintf("rule %d (%s)", rule.idx, reason)
+		}
+	}
+	return r.default_action, "default"
+}
+
+func (rule *routeRule) match(domain string, ip net.IP, port int) (string, bool) {
+	port_reason := ""
+	if len(rule.ports) > 0 {
+		matched := false
+		for _, pr := range rule.ports {
+			if port >= pr[0] && port <= pr[1] {
+				port_reason = fmt.Sprintf("port %d-%d", pr[0], pr[1])
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+
+	if len(rule.suffixes) == 0 && len(rule.keywords) == 0 &&
+		len(rule.regexps) == 0 && rule.cidrs.Len() == 0 {
+		if port_reason == "" {
+			return "any", true
+		}
+		return port_reason, true
+	}
+
+	reason := ""
+	if domain != "" {
+		for _, suffix := range rule.suffixes {
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				reason = "domain-suffix " + suffix
+				break
+			}
+		}
+		for _, kw := range rule.keywords {
+			if reason == "" && strings.Contains(domain, kw) {
+				reason = "domain-keyword " + kw
+				break
+			}
+		}
+		for _, re := range rule.regexps {
+			if reason == "" && re.MatchString(domain) {
+				reason = "domain-regex " + re.String()
+				break
+			}
+		}
+	} else if ip != nil {
+		if rule.cidrs.Contains(ip) {
+			reason = "cidr"
+		}
+	}
+	if reason == "" {
+		return "", false
+	}
+	if port_reason != "" {
+		reason += ", " + port_reason
+	}
+	return reason, true
+}
+
+// cidrSet is a sorted list of merged IP ranges
+type cidrSet struct {
+	ranges [][2][]byte
+}
+
+func (cs *cidrSet) Len() int {
+	return len(cs.ranges)
+}
+
+func (cs *cidrSet) Add(cidr string) error {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return fmt.Errorf("invalid cidr: %s", cidr)
+		}
+		ip = ip.To16()
+		cs.ranges = append(cs.ranges, [2][]byte{ip, ip})
+		return nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	start, end := make([]byte, 16), make([]byte, 16)
+	copy(start, ipnet.IP.To16())
+	mask := ipnet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range start {
+		start[i] &= mask[i]
+		end[i] = start[i] | ^mask[i]
+	}
+	cs.ranges = append(cs.ranges, [2][]byte{start, end})
+	return nil
+}
+
+func (cs *cidrSet) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := cs.Add(line); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line_no, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// build sorts and merges the ranges, must be called after the last Add
+func (cs *cidrSet) build() {
+	sort.Slice(cs.ranges, func(i, j int) bool {
+		return bytes.Compare(cs.ranges[i][0], cs.ranges[j][0]) < 0
+	})
+	merged := cs.ranges[:0]
+	for _, r := range cs.ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r[0], nextIP(merged[n-1][1])) <= 0 {
+			if bytes.Compare(r[1], merged[n-1][1]) > 0 {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	cs.ranges = merged
+}
+
+func (cs *cidrSet) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// first range starts after ip
+	idx := sort.Search(len(cs.ranges), func(i int) bool {
+		return bytes.Compare(cs.ranges[i][0], ip) > 0
+	})
+	return idx > 0 && bytes.Compare(ip, cs.ranges[idx-1][1]) <= 0
+}
+
+// nextIP returns ip+1, the max ip stays unchanged
+func nextIP(ip []byte) []byte {
+	next := make([]byte, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			return next
+		}
+	}
+	return ip
+}
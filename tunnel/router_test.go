@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	f, err := ioutil.TempFile("", "chnroute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n1.0.1.0/24\n1.0.2.0/23\n\n114.114.114.114\n")
+	f.Close()
+
+	router, err := NewRouter([]RouteRule{
+		{DomainSuffix: []string{"ads.example.com"}, Action: "reject"},
+		{DomainSuffix: []string{"cn"}, DomainKeyword: []string{"baidu"}, Action: "direct"},
+		{DomainRegex: []string{`^intra\d+\.`}, Action: "direct"},
+		{CIDR: []string{"10.0.0.0/8", "fd00::/8"}, Action: "direct"},
+		{CIDRFile: []string{f.Name()}, Action: "direct"},
+		{Ports: []string{"25", "6881-6889"}, Action: "reject"},
+	}, "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host   string
+		port   int
+		action RouteAction
+	}{
+		{"ads.example.com", 443, ROUTE_REJECT},
+		{"x.ads.example.com.", 443, ROUTE_REJECT},
+		{"example.com", 443, ROUTE_TUNNEL},
+		{"www.sina.com.cn", 80, ROUTE_DIRECT},
+		{"WWW.BAIDU.COM", 80, ROUTE_DIRECT},
+		{"notcn", 80, ROUTE_TUNNEL},
+		{"intra3.corp", 80, ROUTE_DIRECT},
+		{"10.1.2.3", 80, ROUTE_DIRECT},
+		{"fd12::1", 80, ROUTE_DIRECT},
+		{"1.0.3.255", 80, ROUTE_DIRECT},
+		{"1.0.4.0", 80, ROUTE_TUNNEL},
+		{"114.114.114.114", 53, ROUTE_DIRECT},
+		{"8.8.8.8", 53, ROUTE_TUNNEL},
+		{"8.8.8.8", 6885, ROUTE_REJECT},
+		{"example.com", 25, ROUTE_REJECT},
+	}
+	for _, c := range cases {
+		if action, rule := router.Route(c.host, c.port); action != c.action {
+			t.Errorf("%s:%d expect %s, got %s by %s", c.host, c.port, c.action, action, rule)
+		}
+	}
+}
+
+func TestCIDRSetMerge(t *testing.T) {
+	cs := new(cidrSet)
+	for _, cidr := range []string{"192.168.1.0/24", "192.168.0.0/16", "192.169.0.0/16"} {
+		if err := cs.Add(cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs.build()
+	if cs.Len() != 1 {
+		t.Error("expect 1 range, got", cs.Len())
+	}
+	if !cs.Contains(net.ParseIP("192.169.255.255")) || cs.Contains(net.ParseIP("192.170.0.0")) {
+		t.Error("merged range mismatch")
+	}
+}
@@ -1,12 +1,13 @@
 package tunnel
 
 import (
+	"context"
 	"crypto"
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/golang/glog"
 	"io"
@@ -14,80 +15,331 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Server struct {
-	sessions  *SessionManager
-	config    *ServerConfig
-	user_cfgs *UserConfigs
+var ErrServerClosed = errors.New("tunnel: server closed")
 
-	priv_key    *rsa.PrivateKey
+type Server struct {
+	sessions *SessionManager
+	config   *ServerConfig
+	auth     Authenticator
+	limiter  *userLimiter
+	dialer   Dialer
+	hooks    ServerHooks
+
+	priv_key    crypto.Signer
 	pub_der     []byte
+	rotation    *KeyRotation
 	g_cipher    *GlobalCipherConfig
 	enc_methods []byte
+	cipher_pref byte
 
-	listenser *net.TCPListener
+	listenser net.Listener
+
+	lock     sync.Mutex
+	clients  map[*StreamPipe]*ClientProxy
+	shutdown bool
+	done     chan struct{}
 }
 
 func NewServer(config *ServerConfig) (*Server, error) {
+	transport, err := NewTransport(&config.TransportConfig, true)
+	if err != nil {
+		return nil, err
+	}
+	l, err := transport.Listen(config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	server, err := NewServerWithListener(config, l, nil)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	glog.Infof("listen on: %s", config.ListenAddr)
+	return server, nil
+}
+
+// NewServerWithListener makes a server that accepts clients from l, opts
+// may be nil
+func NewServerWithListener(config *ServerConfig, l net.Listener, opts *ServerOptions) (*Server, error) {
 	server := new(Server)
 	var err error
+	if opts == nil {
+		opts = new(ServerOptions)
+	}
 
 	if len(config.LinkEncryptMethods) == 0 {
 		return nil, fmt.Errorf("encrypt methods can't be empty")
 	}
+	if err := CheckCiphers(config.LinkEncryptMethods, config.MinimumSecurity); err != nil {
+		return nil, err
+	}
 	server.enc_methods = []byte(strings.Join(config.LinkEncryptMethods, ","))
-
-	if server.priv_key, err = LoadRSAPrivateKey(config.KeyPath); err != nil {
+	switch config.CipherPreference {
+	case "", "server":
+		server.cipher_pref = CIPHER_PREF_SERVER
+	case "client":
+		server.cipher_pref = CIPHER_PREF_CLIENT
+	default:
+		return nil, fmt.Errorf("invalid cipher preference: %s (server or client)", config.CipherPreference)
+	}
+
+	if opts.PrivateKey != nil {
+		server.priv_key = opts.PrivateKey
+	} else if server.priv_key, err = LoadPrivateKey(config.KeyPath); err != nil {
 		if os.IsNotExist(err) {
-			glog.Info("generating new private key(RSA 2048bits) ...")
-			if server.priv_key, err = GenerateRSAKey(2048, config.KeyPath); err != nil {
+			key_type := config.KeyType
+			if key_type == "" {
+				key_type = "rsa"
+			}
+			glog.Infof("generating new private key(%s) ...", key_type)
+			if server.priv_key, err = GenerateKey(key_type, 2048, config.KeyPath); err != nil {
 				return nil, err
 			}
 		} else {
 			return nil, err
 		}
 	}
-	if server.pub_der, err = x509.MarshalPKIXPublicKey(&server.priv_key.PublicKey); err != nil {
+	if keyTypeOf(server.priv_key.Public()) == 0 {
+		return nil, fmt.Errorf("unsupported server key %T", server.priv_key)
+	}
+	if server.pub_der, err = x509.MarshalPKIXPublicKey(server.priv_key.Public()); err != nil {
 		return nil, err
 	}
+	glog.Infof("server key %s %s", KeyType(server.priv_key.Public()), derFingerprint(server.pub_der))
+
+	if opts.KeyRotation != nil {
+		server.rotation = opts.KeyRotation
+	} else if opts.PrivateKey == nil {
+		if server.rotation, err = LoadKeyRotation(config.KeyPath + ".rotation"); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	if server.rotation != nil {
+		if err := server.rotation.Verify(server.pub_der); err != nil {
+			return nil, fmt.Errorf("key rotation is not for the server key: %v", err)
+		}
+		glog.Infof("previous key %s trusted until %v",
+			derFingerprint(server.rotation.OldPublicKey), server.rotation.Expire)
+	}
 
 	if config.GlobalEncryptMethod != "" {
+		if err := CheckGlobalCipher(config.GlobalEncryptMethod, config.MinimumSecurity); err != nil {
+			return nil, err
+		}
 		if server.g_cipher, err = LoadGlobalCipherConfig(
 			config.GlobalEncryptMethod, []byte(config.GlobalEncryptPassword)); err != nil {
 			return nil, err
 		}
 	}
 
-	if server.user_cfgs, err = GetUserConfigs(config.UserConfigPath); err != nil {
+	if opts.Auth != nil {
+		server.auth = opts.Auth
+	} else if server.auth, err = GetUserConfigs(config.UserConfigPath); err != nil {
 		return nil, err
 	}
+	server.limiter = newUserLimiter(server.auth)
+	server.dialer = opts.Dialer
+	if server.dialer == nil {
+		server.dialer = new(net.Dialer)
+	}
+	server.hooks = opts.Hooks
+	server.listenser = l
 
-	if l, err := net.Listen("tcp", config.ListenAddr); err == nil {
-		server.listenser = l.(*net.TCPListener)
-		glog.Infof("listen on: %s", config.ListenAddr)
+	if store, err := NewSessionStore(config); err == nil {
+		server.sessions = NewSessionManager(store)
 	} else {
 		return nil, err
 	}
-
-	server.sessions = NewSessionManager()
+	// a file store may keep the sessions from before a restart
+	server.pruneSessions()
 	server.config = config
+	server.clients = make(map[*StreamPipe]*ClientProxy)
+	server.done = make(chan struct{})
 	return server, nil
 }
 
 func (ser *Server) Run() {
+	if err := ser.Serve(context.Background()); err != nil && err != ErrServerClosed {
+		glog.Fatalf("accept fail: %s", err.Error())
+	}
+}
+
+// Serve accepts clients until ctx is done or Shutdown is called, it returns
+// ErrServerClosed in both cases
+func (ser *Server) Serve(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(SESSION_PRUNE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				ser.listenser.Close()
+				return
+			case <-ser.done:
+				return
+			case <-ticker.C:
+				ser.pruneSessions()
+			}
+		}
+	}()
+
 	for {
-		if conn, err := ser.listenser.AcceptTCP(); err != nil {
-			glog.Fatalf("accept fail: %s", err.Error())
+		conn, err := ser.listenser.Accept()
+		if err != nil {
+			if ser.isShutdown() || ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go ser.processClient(conn)
+	}
+}
+
+// ReloadUsers rereads the users file, the logged in clients are kept but
+// the stored sessions of the removed or disabled users and of the users
+// whose password changed are dropped
+func (ser *Server) ReloadUsers() error {
+	users, ok := ser.auth.(*UserConfigs)
+	if !ok {
+		return fmt.Errorf("users are not loaded from a file")
+	}
+	old := make(map[string]*UserConfig)
+	for _, name := range users.Names() {
+		old[name] = users.Get(name)
+	}
+	if err := users.Reload(); err != nil {
+		return err
+	}
+	ser.sessions.PruneSessions(func(s *Session) bool {
+		if !ser.userActive(s.Username) {
+			return true
+		}
+		before, after := old[s.Username], users.Get(s.Username)
+		return before == nil || before.Password != after.Password ||
+			before.PasswordHash != after.PasswordHash
+	})
+	return nil
+}
+
+// pruneSessions deletes the expired sessions and the ones of the users that
+// can't log in any more
+func (ser *Server) pruneSessions() {
+	ser.sessions.PruneSessions(func(s *Session) bool {
+		return !ser.userActive(s.Username)
+	})
+}
+
+// userActive reports whether the sessions of user may be reused
+func (ser *Server) userActive(user string) bool {
+	if status, ok := ser.auth.(UserStatus); ok {
+		return status.Active(user)
+	}
+	return true
+}
+
+func (ser *Server) isShutdown() bool {
+	ser.lock.Lock()
+	defer ser.lock.Unlock()
+	return ser.shutdown
+}
+
+// Shutdown stops accepting clients and new connections, waits for the
+// running connections to finish until ctx is done, then closes every client
+func (ser *Server) Shutdown(ctx context.Context) error {
+	ser.lock.Lock()
+	if !ser.shutdown {
+		ser.shutdown = true
+		close(ser.done)
+	}
+	ser.lock.Unlock()
+	ser.listenser.Close()
+
+	ser.lock.Lock()
+	for pipe, cp := range ser.clients {
+		if cp == nil {
+			// still in startup
+			pipe.Close()
 		} else {
-			go ser.processClient(conn)
+			cp.Drain()
 		}
 	}
+	ser.lock.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if ser.numConns() == 0 {
+			ser.closeClients()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			glog.Infof("shutdown timeout, close %d conns", ser.numConns())
+			ser.closeClients()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ser *Server) numConns() int {
+	ser.lock.Lock()
+	defer ser.lock.Unlock()
+	n := 0
+	for _, cp := range ser.clients {
+		if cp != nil {
+			n += cp.numConns()
+		}
+	}
+	return n
+}
+
+func (ser *Server) closeClients() {
+	ser.lock.Lock()
+	clients := make([]*ClientProxy, 0, len(ser.clients))
+	for pipe, cp := range ser.clients {
+		if cp != nil {
+			clients = append(clients, cp)
+		} else {
+			pipe.Close()
+		}
+	}
+	ser.lock.Unlock()
+
+	for _, cp := range clients {
+		cp.Close()
+	}
+}
+
+func (ser *Server) addClient(pipe *StreamPipe, cp *ClientProxy) bool {
+	ser.lock.Lock()
+	defer ser.lock.Unlock()
+	if ser.shutdown {
+		return false
+	}
+	ser.clients[pipe] = cp
+	return true
+}
+
+func (ser *Server) delClient(pipe *StreamPipe) {
+	ser.lock.Lock()
+	delete(ser.clients, pipe)
+	ser.lock.Unlock()
 }
 
-func (ser *Server) processClient(conn *net.TCPConn) {
+func (ser *Server) processClient(conn net.Conn) {
 	pipe := NewStreamPipe(conn)
 	defer pipe.Close()
+	if !ser.addClient(pipe, nil) {
+		return
+	}
+	defer ser.delClient(pipe)
 
 	if ser.g_cipher != nil {
 		enc, dec, err := ser.g_cipher.NewCipher()
@@ -96,16 +348,35 @@ func (ser *Server) processClient(conn *net.TCPConn) {
 		}
 		pipe.SwitchCipher(enc, dec)
 	}
-	if err := conn.SetNoDelay(true); err != nil {
-		glog.Fatalf("set client NoDelay fail: %s", err.Error())
+	if tcp_conn, ok := conn.(*net.TCPConn); ok {
+		if err := tcp_conn.SetNoDelay(true); err != nil {
+			glog.V(1).Infof("set client NoDelay fail: %s", err.Error())
+			return
+		}
 	}
 
 	user := ser.clientStartup(pipe)
 	if user == nil {
 		return
 	}
-	cli := NewClientProxy(user, pipe)
+	ser.auditSession(user, conn.RemoteAddr())
+	if !ser.limiter.acquireTunnel(user.Username) {
+		glog.Warningf("%s: too many tunnels, refuse %s", user.Username, conn.RemoteAddr())
+		return
+	}
+	defer ser.limiter.releaseTunnel(user.Username)
+	cli := NewClientProxy(user, pipe, ser.dialer, &ser.hooks)
+	cli.limiter = ser.limiter
+	if !ser.addClient(pipe, cli) {
+		return
+	}
+	if ser.hooks.OnConnect != nil {
+		ser.hooks.OnConnect(user, conn.RemoteAddr())
+	}
 	cli.DoProxy()
+	if ser.hooks.OnDisconnect != nil {
+		ser.hooks.OnDisconnect(user, conn.RemoteAddr())
+	}
 }
 
 func (ser *Server) clientStartup(pipe *StreamPipe) *Session {
@@ -122,7 +393,8 @@ func (ser *Server) clientStartup(pipe *StreamPipe) *Session {
 	}
 
 	if header[1] == 0 {
-		return ser.newSession(pipe)
+		// random_size of a new session request is the startup version
+		return ser.newSession(pipe, header[2])
 	}
 	if header[2] == 0 || header[3] == 0 {
 		glog.V(1).Info("reuse session, 0 random/hmac")
@@ -140,7 +412,48 @@ func (ser *Server) clientStartup(pipe *StreamPipe) *Session {
 		body[header[1]+header[2]:])
 }
 
-func (ser *Server) newSession(pipe *StreamPipe) *Session {
+// startupExt returns the Startup Response extensions
+func (ser *Server) startupExt() []byte {
+	ext := appendStartupExt(nil, STARTUP_EXT_KEY_TYPE, []byte{keyTypeOf(ser.priv_key.Public())})
+	ext = appendStartupExt(ext, STARTUP_EXT_CIPHER_PREF, []byte{ser.cipher_pref})
+	if ser.rotation != nil && time.Now().Before(ser.rotation.Expire) {
+		ext = appendStartupExt(ext, STARTUP_EXT_KEY_ROTATION, ser.rotation.Marshal())
+	}
+	return ext
+}
+
+// sizedStartupExt returns ext_size and ext
+func sizedStartupExt(ext []byte) []byte {
+	raw := make([]byte, 2, 2+len(ext))
+	WriteN2(raw, 0, uint16(len(ext)))
+	return append(raw, ext...)
+}
+
+func appendStartupExt(ext []byte, ext_type byte, data []byte) []byte {
+	field := make([]byte, 3)
+	field[0] = ext_type
+	WriteN2(field, 1, uint16(len(data)))
+	return append(append(ext, field...), data...)
+}
+
+// auditSession logs the cipher a client logged in with, rank is the place
+// of the cipher in the server preference
+func (ser *Server) auditSession(s *Session, addr net.Addr) {
+	cipher_name, security, rank := "none", "", 0
+	if s.CipherConfig != nil {
+		cipher_name, security = s.CipherConfig.Name, s.CipherConfig.Security.String()
+		for i, md := range ser.config.LinkEncryptMethods {
+			if md == cipher_name {
+				rank = i + 1
+				break
+			}
+		}
+	}
+	glog.Infof("session %s user %s from %s: cipher %s security %s rank %d/%d",
+		s.Id, s.Username, addr, cipher_name, security, rank, len(ser.config.LinkEncryptMethods))
+}
+
+func (ser *Server) newSession(pipe *StreamPipe, startup_ver byte) *Session {
 	ctx, err := NewCipherContext(5)
 	if err != nil {
 		glog.Errorf("create cipher context fail: %s", err.Error())
@@ -153,8 +466,16 @@ func (ser *Server) newSession(pipe *StreamPipe) *Session {
 	}
 	p_bs, f_bs := ctx.P.Bytes(), f.Bytes()
 
-	buf := make([]byte, len(ser.pub_der)+len(p_bs)+len(f_bs)+len(ser.enc_methods)+2048)
-	WriteN2(buf, 0, uint16(len(ser.pub_der)))
+	var ext []byte
+	if startup_ver >= STARTUP_VERSION_EXT {
+		ext = ser.startupExt()
+	}
+	buf := make([]byte, len(ser.pub_der)+len(p_bs)+len(f_bs)+len(ser.enc_methods)+len(ext)+2048)
+	if startup_ver >= STARTUP_VERSION_EXT {
+		WriteN2(buf, 0, uint16(len(ser.pub_der))|STARTUP_EXT_FLAG)
+	} else {
+		WriteN2(buf, 0, uint16(len(ser.pub_der)))
+	}
 	WriteN2(buf, 2, uint16(len(p_bs)))
 	WriteN2(buf, 4, uint16(len(f_bs)))
 	WriteN2(buf, 8, uint16(len(ser.enc_methods)))
@@ -165,9 +486,12 @@ func (ser *Server) newSession(pipe *StreamPipe) *Session {
 	cur += 1
 	cur += copy(buf[cur:], f_bs)
 
-	hash_bs := sha256.Sum256(buf[10+len(ser.pub_der) : cur])
-	if sig, err := rsa.SignPKCS1v15(rand.Reader, ser.priv_key, crypto.SHA256,
-		hash_bs[:]); err != nil {
+	signed := buf[10+len(ser.pub_der) : cur]
+	if startup_ver >= STARTUP_VERSION_EXT {
+		signed = append(append(append([]byte(nil), signed...), ser.enc_methods...),
+			sizedStartupExt(ext)...)
+	}
+	if sig, err := signData(ser.priv_key, signed); err != nil {
 		glog.Errorf("sign p/g/f fail: %s", err.Error())
 		return nil
 	} else {
@@ -175,6 +499,9 @@ func (ser *Server) newSession(pipe *StreamPipe) *Session {
 		cur += copy(buf[cur:], sig)
 	}
 	cur += copy(buf[cur:], ser.enc_methods)
+	if startup_ver >= STARTUP_VERSION_EXT {
+		cur += copy(buf[cur:], sizedStartupExt(ext))
+	}
 
 	if _, err := pipe.Write(buf[:cur]); err != nil {
 		glog.V(1).Infof("write pipe fail: %s", err.Error())
@@ -205,22 +532,23 @@ func (ser *Server) newSession(pipe *StreamPipe) *Session {
 		}
 	}
 	if cipher_cfg == nil {
-		glog.V(1).Infof("invalid method: %s", method)
+		glog.Warningf("client chose %q which is not in LinkEncryptMethods", method)
 		return nil
 	}
 	ctx.CalcKey(new(big.Int).SetBytes(buf[:e_size]))
 	key, iv := ctx.MakeCryptoKeyIV(cipher_cfg.KeySize, cipher_cfg.IVSize)
-	if enc, dec, err := cipher_cfg.NewCipher(key, iv); err != nil {
-		glog.Errorf("new stream cipher fail: %s", err.Error())
+	if err := cipher_cfg.SwitchPipe(pipe, key, iv, true); err != nil {
+		glog.Errorf("new link cipher fail: %s", err.Error())
 		return nil
-	} else {
-		pipe.SwitchCipher(enc, dec)
 	}
 
 	s := ser.clientLogin(ctx, pipe)
 	if s != nil {
 		s.CipherCtx = ctx
 		s.CipherConfig = cipher_cfg
+		if err := ser.sessions.SaveSession(s); err != nil {
+			glog.Errorf("save session fail: %s", err.Error())
+		}
 	}
 	return s
 }
@@ -231,6 +559,7 @@ func (ser *Server) clientLogin(ctx *CipherContext, pipe *StreamPipe) *Session {
 		glog.V(1).Infof("receive login req fail: %s", err.Error())
 		return nil
 	}
+	client_version := ReadN2(buf, 0)
 
 	// rep
 	login_ok := B_FALSE
@@ -244,9 +573,10 @@ func (ser *Server) clientLogin(ctx *CipherContext, pipe *StreamPipe) *Session {
 			return nil
 		}
 		user, passwd := string(buf[:user_size]), buf[user_size:user_size+passwd_size]
-		user_cfg := ser.user_cfgs.Get(user)
-		if user_cfg == nil || user_cfg.Password != string(passwd) {
+		if !ser.auth.Authenticate(user, string(passwd)) {
 			msg = []byte("invalid username/password")
+		} else if ser.limiter.tunnelsFull(user) {
+			msg = []byte("too many tunnels")
 		} else {
 			login_ok = B_TRUE
 			var err error
@@ -255,6 +585,7 @@ func (ser *Server) clientLogin(ctx *CipherContext, pipe *StreamPipe) *Session {
 				return nil
 			}
 			s.Username = string(user)
+			s.ClientVersion = client_version
 			if msg, err = s.Id.Bytes(); err != nil {
 				glog.Errorf("sessionId toBytes fail: %s", err.Error())
 				return nil
@@ -282,27 +613,63 @@ func CheckMAC(message, messageMAC, key []byte) bool {
 	return hmac.Equal(messageMAC, expectedMAC)
 }
 
+// reuseSession resumes a stored session with a link key made from the
+// random data of both sides, the failed reuses start a new cipher exchange
 func (ser *Server) reuseSession(pipe *StreamPipe, s_bs, rand_bs, hmac_bs []byte) *Session {
 	sessionId := SessionIdFromBytes(s_bs)
 	s := ser.sessions.GetSession(sessionId)
-	if s == nil {
-		return nil
-	}
 
-	do_init := false
-	rep := []byte{B_TRUE, REUSE_SUCCESS}
-	if !CheckMAC(rand_bs, hmac_bs, s.CipherCtx.CryptoKey) {
-		rep[0] = B_FALSE
-		rep[1] = REUSE_FAIL_START_CIPHER_EXCHANGE | REUSE_FAIL_HMAC_FAIL
-		do_init = true
+	var fail byte
+	switch {
+	case s == nil || s.CipherCtx == nil || !ser.offersCipher(s.CipherConfig):
+		fail = REUSE_FAIL_NO_SESSION
+	case !CheckMAC(rand_bs, hmac_bs, s.CipherCtx.CryptoKey):
+		fail = REUSE_FAIL_HMAC_FAIL
+	case !ser.userActive(s.Username):
+		// the user was removed or disabled after the login
+		ser.sessions.DelSession(sessionId)
+		fail = REUSE_FAIL_NO_USER
+	}
+	if fail != 0 {
+		if _, err := pipe.Write([]byte{B_FALSE, REUSE_FAIL_START_CIPHER_EXCHANGE | fail}); err != nil {
+			glog.V(1).Infof("write reuse rep fail: %s", err.Error())
+			return nil
+		}
+		return ser.newSession(pipe, STARTUP_VERSION_EXT)
 	}
 
+	ser_rand := make([]byte, REUSE_RANDOM_SIZE)
+	if _, err := rand.Read(ser_rand); err != nil {
+		glog.Errorf("make reuse random fail: %s", err.Error())
+		return nil
+	}
+	rep := make([]byte, 5, 5+len(ser_rand)+sha256.Size)
+	rep[0], rep[1] = B_TRUE, REUSE_SUCCESS
+	WriteN2(rep, 2, PROTO_VERSION)
+	rep[4] = byte(len(ser_rand))
+	rep = append(rep, ser_rand...)
+	rep = append(rep, reuseMAC(s.CipherCtx.CryptoKey, "breaksocks reuse proof", rand_bs, rep[2:])...)
 	if _, err := pipe.Write(rep); err != nil {
-		glog.V(1).Infof("write init rep fail: %s", err.Error())
+		glog.V(1).Infof("write reuse rep fail: %s", err.Error())
 		return nil
 	}
-	if do_init {
-		return ser.newSession(pipe)
+
+	key, iv := reuseKeyIV(s.CipherCtx.CryptoKey, rand_bs, ser_rand, s.CipherConfig)
+	if err := s.CipherConfig.SwitchPipe(pipe, key, iv, true); err != nil {
+		glog.Errorf("new link cipher fail: %s", err.Error())
+		return nil
 	}
 	return s
 }
+
+// offersCipher reports whether cfg is one of LinkEncryptMethods
+func (ser *Server) offersCipher(cfg *CipherConfig) bool {
+	if cfg != nil {
+		for _, md := range ser.config.LinkEncryptMethods {
+			if md == cfg.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,11 +1,15 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 type proxyConn struct {
@@ -15,18 +19,27 @@ type proxyConn struct {
 type ClientProxy struct {
 	session *Session
 	pipe    *StreamPipe
-	closed  bool
+	dialer  Dialer
+	hooks   *ServerHooks
+	limiter *userLimiter
+	closed  atomic.Bool
 	write   chan []byte
+	wlock   sync.Mutex
 
-	lock  sync.RWMutex
-	conns map[uint32]*proxyConn
+	lock     sync.RWMutex
+	conns    map[uint32]*proxyConn
+	draining bool
 }
 
-func NewClientProxy(session *Session, pipe *StreamPipe) *ClientProxy {
+func NewClientProxy(session *Session, pipe *StreamPipe, dialer Dialer, hooks *ServerHooks) *ClientProxy {
+	if hooks == nil {
+		hooks = new(ServerHooks)
+	}
 	return &ClientProxy{
 		session: session,
 		pipe:    pipe,
-		closed:  false,
+		dialer:  dialer,
+		hooks:   hooks,
 		write:   make(chan []byte),
 		conns:   make(map[uint32]*proxyConn)}
 }
@@ -75,13 +88,50 @@ func (cp *ClientProxy) closeAllConns() {
 	cp.lock.Unlock()
 }
 
+func (cp *ClientProxy) numConns() int {
+	cp.lock.RLock()
+	defer cp.lock.RUnlock()
+	return len(cp.conns)
+}
+
+// Drain makes the proxy refuse new connections, the running ones go on
+func (cp *ClientProxy) Drain() {
+	cp.lock.Lock()
+	cp.draining = true
+	cp.lock.Unlock()
+}
+
+// Close sends close packets for every running connection and closes the pipe
+func (cp *ClientProxy) Close() {
+	cp.lock.RLock()
+	conn_ids := make([]uint32, 0, len(cp.conns))
+	for conn_id := range cp.conns {
+		conn_ids = append(conn_ids, conn_id)
+	}
+	cp.lock.RUnlock()
+
+	cp.wlock.Lock()
+	if !cp.closed.Load() {
+		for _, conn_id := range conn_ids {
+			if _, err := cp.pipe.Write(makeClosePacket(conn_id)); err != nil {
+				glog.V(1).Infof("write close(%d) fail: %s", conn_id, err.Error())
+				break
+			}
+		}
+		cp.closed.Store(true)
+	}
+	cp.wlock.Unlock()
+	cp.pipe.Close()
+}
+
 func (cp *ClientProxy) DoProxy() {
 	send_to_client_exit := make(chan bool)
 	go func() {
 		for {
 			select {
 			case data := <-cp.write:
-				if !cp.closed {
+				cp.wlock.Lock()
+				if !cp.closed.Load() {
 					conn_id := ReadN4(data, 4)
 					if n, err := cp.pipe.Write(data); err != nil {
 						glog.V(1).Infof("write to client fail: %s", err.Error())
@@ -89,6 +139,7 @@ func (cp *ClientProxy) DoProxy() {
 						glog.V(3).Infof("pipe(%d) writted %d", conn_id, n-8)
 					}
 				}
+				cp.wlock.Unlock()
 			case <-send_to_client_exit:
 				// clear write queue
 				for {
@@ -103,7 +154,7 @@ func (cp *ClientProxy) DoProxy() {
 	}()
 
 	defer func() {
-		cp.closed = true
+		cp.closed.Store(true)
 		cp.closeAllConns()
 		send_to_client_exit <- true
 	}()
@@ -137,14 +188,43 @@ func (cp *ClientProxy) DoProxy() {
 			case PACKET_PROXY:
 				cp.sendToConn(conn_id, pkt_data)
 			case PACKET_NEW_CONN:
+				cp.lock.RLock()
+				draining := cp.draining
+				cp.lock.RUnlock()
+				if draining {
+					glog.V(1).Infof("draining, refuse conn: %d", conn_id)
+					cp.write <- cp.connFailPacket(conn_id, CONN_ERR_GENERAL, "server is shutting down")
+					break
+				}
+				if len(pkt_data) < 4 || len(pkt_data) < 4+int(pkt_data[1]) {
+					glog.V(1).Infof("invalid new conn packet: %d", conn_id)
+					cp.write <- cp.connFailPacket(conn_id, CONN_ERR_GENERAL, "invalid new conn packet")
+					break
+				}
 				conn_type := pkt_data[0]
-				//addr_size := int(pkt_data[1])
 				port := ReadN2(pkt_data, 2)
-				addr := pkt_data[4:]
+				addr := pkt_data[4 : 4+int(pkt_data[1])]
+				sub_identity := ""
+				if ident := pkt_data[4+len(addr):]; len(ident) > 0 && len(ident) > int(ident[0]) &&
+					cp.session.ClientVersion >= PROTO_VERSION_SUB_IDENTITY {
+					sub_identity = string(ident[1 : 1+ident[0]])
+				}
+				if !cp.limiter.acquireConn(cp.session.Username) {
+					glog.V(1).Infof("%s: too many conns, refuse conn: %d", cp.session.Username, conn_id)
+					cp.write <- cp.connFailPacket(conn_id, CONN_ERR_NOT_ALLOWED, "too many connections")
+					break
+				}
 				pconn := cp.newConn(conn_id)
 				go func() {
-					if conn, err := cp.connectRemote(conn_type, addr, port); err == nil {
+					defer cp.limiter.releaseConn(cp.session.Username)
+					if conn, err := cp.connectRemote(conn_type, addr, port, sub_identity); err == nil {
+						if cp.session.ClientVersion >= PROTO_VERSION_CONN_REPLY {
+							cp.write <- makeConnOkPacket(conn_id,
+								tcpAddrOf(conn.LocalAddr()), tcpAddrOf(conn.RemoteAddr()))
+						}
 						cp.copyRemote(pconn.read, conn_id, conn)
+					} else if !cp.closed.Load() {
+						cp.write <- cp.connFailPacket(conn_id, connErrCode(err), err.Error())
 					}
 					cp.closeConn(conn_id, pconn)
 				}()
@@ -155,55 +235,90 @@ func (cp *ClientProxy) DoProxy() {
 	}
 }
 
-func (cp *ClientProxy) connectRemote(conn_type byte, addr []byte, port uint16) (*net.TCPConn, error) {
-	var rconn *net.TCPConn
+// connFailPacket tells the client that a new conn failed, clients before
+// PROTO_VERSION_CONN_REPLY only know about the close packet
+func (cp *ClientProxy) connFailPacket(conn_id uint32, code uint16, msg string) []byte {
+	if cp.session.ClientVersion >= PROTO_VERSION_CONN_REPLY {
+		return makeConnFailPacket(conn_id, code, msg)
+	}
+	return makeClosePacket(conn_id)
+}
 
-	if conn_type == PROTO_ADDR_IP {
-		var remote_addr net.TCPAddr
-		remote_addr.IP = net.IP(addr)
-		remote_addr.Port = int(port)
-		if conn, err := net.DialTCP("tcp", nil, &remote_addr); err == nil {
-			rconn = conn
-		} else {
-			glog.V(1).Infof("conn %#v fail: %s", remote_addr, err.Error())
-			return nil, err
+func connErrCode(err error) uint16 {
+	if cerr, ok := err.(*ConnError); ok {
+		return cerr.Code
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return CONN_ERR_TTL_EXPIRED
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return CONN_ERR_HOST_UNREACHABLE
+	}
+	if operr, ok := err.(*net.OpError); ok {
+		if _, ok := operr.Err.(*net.DNSError); ok {
+			return CONN_ERR_HOST_UNREACHABLE
+		}
+		if serr, ok := operr.Err.(*os.SyscallError); ok {
+			switch serr.Err {
+			case syscall.ECONNREFUSED:
+				return CONN_ERR_REFUSED
+			case syscall.ENETUNREACH:
+				return CONN_ERR_NETWORK_UNREACHABLE
+			case syscall.EHOSTUNREACH:
+				return CONN_ERR_HOST_UNREACHABLE
+			}
 		}
+	}
+	return CONN_ERR_GENERAL
+}
+
+func (cp *ClientProxy) connectRemote(conn_type byte, addr []byte, port uint16, sub_identity string) (net.Conn, error) {
+	network := "tcp"
+	if conn_type&PROTO_CONN_UDP != 0 && cp.session.ClientVersion >= PROTO_VERSION_UDP {
+		network = "udp"
+	}
+	conn_type &^= PROTO_CONN_UDP
+
+	var raddr string
+	if conn_type == PROTO_ADDR_IP {
+		raddr = net.JoinHostPort(net.IP(addr).String(), fmt.Sprintf("%d", port))
 	} else {
-		raddr := net.JoinHostPort(string(addr), fmt.Sprintf("%d", port))
-		if conn, err := net.Dial("tcp", raddr); err == nil {
-			rconn = conn.(*net.TCPConn)
-		} else {
-			glog.V(1).Infof("conn %#v fail: %s", raddr, err.Error())
-			return nil, err
+		raddr = net.JoinHostPort(string(addr), fmt.Sprintf("%d", port))
+	}
+
+	if cp.hooks.OnStreamOpen != nil {
+		if err := cp.hooks.OnStreamOpen(cp.session, network, raddr, sub_identity); err != nil {
+			glog.V(1).Infof("conn %s(%s) refused: %s", raddr, sub_identity, err.Error())
+			return nil, &ConnError{Code: CONN_ERR_NOT_ALLOWED, Msg: err.Error()}
 		}
 	}
 
-	return rconn, nil
+	conn, err := cp.dialer.DialContext(context.Background(), network, raddr)
+	if err != nil {
+		glog.V(1).Infof("conn %s fail: %s", raddr, err.Error())
+		return nil, err
+	}
+	return conn, nil
 }
 
-func (cp *ClientProxy) copyRemote(read chan []byte, conn_id uint32, conn *net.TCPConn) {
+func (cp *ClientProxy) copyRemote(read chan []byte, conn_id uint32, conn net.Conn) {
 	remote_read_exit := make(chan bool, 1)
 	copy_write := make(chan []byte, 512)
-	closed_by_client := false
+	var closed_by_client atomic.Bool
 
 	// remote chan -> client
 	go func() {
 		// exit: copy_write reach end or cp.closed or client closed
-		for !cp.closed {
+		for !cp.closed.Load() {
 			data, ok := <-copy_write
-			if !ok || cp.closed || closed_by_client {
+			if !ok || cp.closed.Load() || closed_by_client.Load() {
 				break
 			}
 			cp.write <- data
 		}
 
-		if !cp.closed && !closed_by_client {
-			buf := make([]byte, 8)
-			buf[0] = PROTO_MAGIC
-			buf[1] = PACKET_CLOSE_CONN
-			WriteN2(buf, 2, 0)
-			WriteN4(buf, 4, conn_id)
-			cp.write <- buf
+		if !cp.closed.Load() && !closed_by_client.Load() {
+			cp.write <- makeClosePacket(conn_id)
 		}
 	}()
 
@@ -213,7 +328,7 @@ func (cp *ClientProxy) copyRemote(read chan []byte, conn_id uint32, conn *net.TC
 		for {
 			buf := make([]byte, 2048)
 			if n, err := conn.Read(buf[8:]); err == nil {
-				if cp.closed {
+				if cp.closed.Load() {
 					break
 				}
 				buf[0] = PROTO_MAGIC
@@ -237,7 +352,7 @@ func (cp *ClientProxy) copyRemote(read chan []byte, conn_id uint32, conn *net.TC
 		select {
 		case data, ok := <-read:
 			if !ok {
-				closed_by_client = true
+				closed_by_client.Store(true)
 				return
 			}
 			if n, err := conn.Write(data); err != nil {
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"sync"
+)
+
+// userLimiter counts the tunnels and connections of every user against the
+// limits of UserLimits, a nil limiter allows everything
+type userLimiter struct {
+	limits UserLimits
+
+	lock    sync.Mutex
+	tunnels map[string]int
+	conns   map[string]int
+}
+
+func newUserLimiter(auth Authenticator) *userLimiter {
+	limits, ok := auth.(UserLimits)
+	if !ok {
+		return nil
+	}
+	return &userLimiter{
+		limits:  limits,
+		tunnels: make(map[string]int),
+		conns:   make(map[string]int)}
+}
+
+func (l *userLimiter) acquire(counts map[string]int, user string, max int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if max > 0 && counts[user] >= max {
+		return false
+	}
+	counts[user]++
+	return true
+}
+
+func (l *userLimiter) release(counts map[string]int, user string) {
+	l.lock.Lock()
+	if counts[user]--; counts[user] <= 0 {
+		delete(counts, user)
+	}
+	l.lock.Unlock()
+}
+
+func (l *userLimiter) tunnelsFull(user string) bool {
+	if l == nil {
+		return false
+	}
+	max, _ := l.limits.Limits(user)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return max > 0 && l.tunnels[user] >= max
+}
+
+func (l *userLimiter) acquireTunnel(user string) bool {
+	if l == nil {
+		return true
+	}
+	max, _ := l.limits.Limits(user)
+	return l.acquire(l.tunnels, user, max)
+}
+
+func (l *userLimiter) releaseTunnel(user string) {
+	if l != nil {
+		l.release(l.tunnels, user)
+	}
+}
+
+func (l *userLimiter) acquireConn(user string) bool {
+	if l == nil {
+		return true
+	}
+	_, max := l.limits.Limits(user)
+	return l.acquire(l.conns, user, max)
+}
+
+func (l *userLimiter) releaseConn(user string) {
+	if l != nil {
+		l.release(l.conns, user)
+	}
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"context"
+	"crypto"
+	"net"
+)
+
+// Dialer makes the outbound connections of server
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Authenticator checks the username/password of a login request
+type Authenticator interface {
+	Authenticate(user, passwd string) bool
+}
+
+// UserStatus is implemented by the Authenticators that know whether a user
+// still exists and is enabled, the users of the other Authenticators are
+// always active
+type UserStatus interface {
+	Active(user string) bool
+}
+
+// UserLimits is implemented by the Authenticators that limit the concurrent
+// tunnels and proxied connections of a user, 0 is unlimited
+type UserLimits interface {
+	Limits(user string) (max_tunnels, max_conns int)
+}
+
+type ServerHooks struct {
+	// called after a client logged in
+	OnConnect func(s *Session, addr net.Addr)
+	// called when the tunnel of a logged in client is closed
+	OnDisconnect func(s *Session, addr net.Addr)
+	// called before connecting to address, a non nil error refuses the
+	// connection with CONN_ERR_NOT_ALLOWED. sub_identity is the local user
+	// the client opened it for, empty if not sent.
+	OnStreamOpen func(s *Session, network, address, sub_identity string) error
+}
+
+// ServerOptions replaces the parts of Server that NewServer builds from the
+// config files, nil fields keep the default
+type ServerOptions struct {
+	// RSA, Ed25519 or ECDSA P-256, default: load or generate at config.KeyPath
+	PrivateKey crypto.Signer
+	// default: load from <config.KeyPath>.rotation if PrivateKey is nil
+	KeyRotation *KeyRotation
+	// default: net.Dialer
+	Dialer Dialer
+	// default: users file at config.UserConfigPath
+	Auth  Authenticator
+	Hooks ServerHooks
+}
+
+// tcpAddrOf converts addr to a *net.TCPAddr, addresses of non TCP conns
+// become the zero address
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if tcp_addr, ok := addr.(*net.TCPAddr); ok {
+		return tcp_addr
+	}
+	if addr != nil {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				if port_n, err := net.LookupPort("tcp", port); err == nil {
+					return &net.TCPAddr{IP: ip, Port: port_n}
+				}
+			}
+		}
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAuth map[string]string
+
+func (a testAuth) Authenticate(user, passwd string) bool {
+	return a[user] == passwd
+}
+
+// pipeDialer connects every address to an in-memory echo conn
+type pipeDialer struct {
+	lock  sync.Mutex
+	addrs []string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.lock.Lock()
+	d.addrs = append(d.addrs, address)
+	d.lock.Unlock()
+
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+	return c1, nil
+}
+
+func TestServerOptions(t *testing.T) {
+	dialer := new(pipeDialer)
+	events := make(chan string, 16)
+	idents := make(chan string, 1)
+	opts := &ServerOptions{
+		Dialer: dialer,
+		Auth:   testAuth{"user": "passwd"},
+		Hooks: ServerHooks{
+			OnConnect: func(s *Session, addr net.Addr) {
+				events <- "connect " + s.Username
+			},
+			OnDisconnect: func(s *Session, addr net.Addr) {
+				events <- "disconnect " + s.Username
+			},
+			OnStreamOpen: func(s *Session, network, address, sub_identity string) error {
+				if address == "blocked.example:80" {
+					return fmt.Errorf("blocked")
+				} else if address == "ident.example:7" {
+					idents <- sub_identity
+				}
+				return nil
+			},
+		},
+	}
+	_, cli, cleanup := newTestTunnelWithOptions(t, opts)
+	defer cleanup()
+
+	select {
+	case ev := <-events:
+		if ev != "connect user" {
+			t.Error("unexpected event", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no connect event")
+	}
+
+	conn, err := cli.Dial("tcp", "echo.example:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Error("echo fail", err, string(buf))
+	}
+	conn.Close()
+
+	dialer.lock.Lock()
+	if len(dialer.addrs) != 1 || dialer.addrs[0] != "echo.example:7" {
+		t.Error("dialed addrs", dialer.addrs)
+	}
+	dialer.lock.Unlock()
+
+	_, err = cli.Dial("tcp", "blocked.example:80")
+	if operr, ok := err.(*net.OpError); !ok {
+		t.Error("expect OpError, got", err)
+	} else if cerr, ok := operr.Err.(*ConnError); !ok || cerr.Code != CONN_ERR_NOT_ALLOWED {
+		t.Error("expect not allowed, got", operr.Err)
+	}
+
+	cli.config.ForwardSubIdentity = true
+	if conn, err := cli.DialContextAs(context.Background(), "alice", "tcp", "ident.example:7"); err != nil {
+		t.Error(err)
+	} else {
+		conn.Close()
+	}
+	select {
+	case ident := <-idents:
+		if ident != "alice" {
+			t.Error("sub identity", ident)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("no sub identity")
+	}
+
+	cli.Close()
+	select {
+	case ev := <-events:
+		if ev != "disconnect user" {
+			t.Error("unexpected event", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no disconnect event")
+	}
+}
+
+func TestReuseSessionCustomAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testAuth has no UserStatus, its users are kept active
+	ser, cleanup := startTestServer(t, l, &ServerOptions{Auth: testAuth{"user": "passwd"}}, "")
+	defer cleanup()
+
+	key := []byte("0123456789abcdef")
+	sid := []byte("session-1")
+	ser.sessions.SaveSession(&Session{Id: SessionIdFromBytes(sid), Username: "user",
+		CipherCtx: &CipherContext{CryptoKey: key}, CipherConfig: GetCipherConfig("aes-256")})
+	ser.pruneSessions()
+	if ser.sessions.GetSession(SessionIdFromBytes(sid)) == nil {
+		t.Fatal("session pruned")
+	}
+	if ok, code := reuseTestSession(t, l.Addr().String(), sid, key); ok != B_TRUE || code != REUSE_SUCCESS {
+		t.Error("reuse", ok, code)
+	}
+}
@@ -19,8 +19,9 @@ func (sid SessionId) size() int {
 }
 
 type Session struct {
-	Id           SessionId
-	Username     string
-	CipherCtx    *CipherContext
-	CipherConfig *CipherConfig
+	Id            SessionId
+	Username      string
+	ClientVersion uint16
+	CipherCtx     *CipherContext
+	CipherConfig  *CipherConfig
 }
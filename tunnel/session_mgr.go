@@ -1,20 +1,22 @@
 package tunnel
 
 import (
-	"sync"
+	"github.com/golang/glog"
 )
 
 type SessionManager struct {
-	lock     sync.RWMutex
-	sessions map[SessionId]*Session
+	store SessionStore
 }
 
-func NewSessionManager() *SessionManager {
-	mgr := &SessionManager{}
-	mgr.sessions = make(map[SessionId]*Session)
-	return mgr
+func NewSessionManager(store SessionStore) *SessionManager {
+	if store == nil {
+		store = NewMemorySessionStore(DEFAULT_SESSION_TTL)
+	}
+	return &SessionManager{store: store}
 }
 
+// NewSession makes a session with a fresh id, it is stored by SaveSession
+// once the login has been finished
 func (mgr *SessionManager) NewSession(ctx *CipherContext) (*Session, error) {
 	session_id, err := ctx.MakeSessionId()
 	if err != nil {
@@ -23,23 +25,31 @@ func (mgr *SessionManager) NewSession(ctx *CipherContext) (*Session, error) {
 
 	session := &Session{}
 	session.Id = session_id
-
-	mgr.lock.Lock()
-	defer mgr.lock.Unlock()
-	mgr.sessions[session_id] = session
 	return session, nil
 }
 
+func (mgr *SessionManager) SaveSession(s *Session) error {
+	return mgr.store.Put(s)
+}
+
 func (mgr *SessionManager) GetSession(sid SessionId) *Session {
-	mgr.lock.RLock()
-	defer mgr.lock.RUnlock()
+	s, err := mgr.store.Get(sid)
+	if err != nil {
+		glog.Errorf("get session %s fail: %s", sid, err.Error())
+		return nil
+	}
+	return s
+}
 
-	return mgr.sessions[sid]
+// PruneSessions deletes the stored sessions that drop returns true for
+func (mgr *SessionManager) PruneSessions(drop func(s *Session) bool) {
+	if err := mgr.store.Prune(drop); err != nil {
+		glog.Errorf("prune sessions fail: %s", err.Error())
+	}
 }
 
 func (mgr *SessionManager) DelSession(sid SessionId) {
-	mgr.lock.Lock()
-	defer mgr.lock.Unlock()
-
-	delete(mgr.sessions, sid)
+	if err := mgr.store.Del(sid); err != nil {
+		glog.Errorf("del session %s fail: %s", sid, err.Error())
+	}
 }
@@ -0,0 +1,286 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_STORE_MEMORY = "memory"
+	SESSION_STORE_FILE   = "file"
+
+	// lifetime of a stored session if ServerConfig.SessionTTL is 0
+	DEFAULT_SESSION_TTL = 24 * time.Hour
+	// how often a running server deletes the expired sessions
+	SESSION_PRUNE_INTERVAL = 10 * time.Minute
+)
+
+// SessionStore keeps the sessions that a client may resume with the
+// reuse-session startup request. A session expires ttl after Put, Get
+// returns nil for the expired ones.
+type SessionStore interface {
+	Put(s *Session) error
+	Get(sid SessionId) (*Session, error)
+	Del(sid SessionId) error
+	// Prune deletes the expired sessions and the ones drop returns true for
+	Prune(drop func(s *Session) bool) error
+}
+
+func NewSessionStore(config *ServerConfig) (SessionStore, error) {
+	ttl := config.SessionTTL
+	if ttl <= 0 {
+		ttl = DEFAULT_SESSION_TTL
+	}
+	switch config.SessionStore {
+	case "", SESSION_STORE_MEMORY:
+		return NewMemorySessionStore(ttl), nil
+	case SESSION_STORE_FILE:
+		if config.SessionStoreKey == "" {
+			return nil, fmt.Errorf("session store key can't be empty")
+		}
+		return NewFileSessionStore(config.SessionStorePath, []byte(config.SessionStoreKey), ttl)
+	}
+	return nil, fmt.Errorf("no such session store: %s", config.SessionStore)
+}
+
+type memorySession struct {
+	s      *Session
+	expire time.Time
+}
+
+type MemorySessionStore struct {
+	ttl      time.Duration
+	lock     sync.RWMutex
+	sessions map[SessionId]memorySession
+}
+
+func NewMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{ttl: ttl, sessions: make(map[SessionId]memorySession)}
+}
+
+func (ms *MemorySessionStore) Put(s *Session) error {
+	ms.lock.Lock()
+	ms.sessions[s.Id] = memorySession{s: s, expire: time.Now().Add(ms.ttl)}
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *MemorySessionStore) Get(sid SessionId) (*Session, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if entry, ok := ms.sessions[sid]; ok && time.Now().Before(entry.expire) {
+		return entry.s, nil
+	}
+	return nil, nil
+}
+
+func (ms *MemorySessionStore) Del(sid SessionId) error {
+	ms.lock.Lock()
+	delete(ms.sessions, sid)
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *MemorySessionStore) Prune(drop func(s *Session) bool) error {
+	now := time.Now()
+	ms.lock.Lock()
+	for sid, entry := range ms.sessions {
+		if !now.Before(entry.expire) || drop(entry.s) {
+			delete(ms.sessions, sid)
+		}
+	}
+	ms.lock.Unlock()
+	return nil
+}
+
+// sessionEntry is the on-disk form of a Session
+type sessionEntry struct {
+	Id        string
+	Username  string
+	Version   uint16
+	Cipher    string
+	CryptoKey []byte
+	IV        []byte
+	// the entries without it are expired
+	Expire time.Time
+}
+
+// FileSessionStore saves every session as a single AES-GCM sealed file under
+// dir, so it survives restarts and can be shared by several servers.
+type FileSessionStore struct {
+	dir  string
+	ttl  time.Duration
+	aead cipher.AEAD
+}
+
+func NewFileSessionStore(dir string, key []byte, ttl time.Duration) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir, ttl: ttl, aead: aead}, nil
+}
+
+func (fs *FileSessionStore) path(sid SessionId) (string, error) {
+	bs, err := sid.Bytes()
+	if err != nil {
+		return "", err
+	}
+	if len(bs) == 0 {
+		return "", fmt.Errorf("empty session id")
+	}
+	return filepath.Join(fs.dir, hex.EncodeToString(bs)), nil
+}
+
+func (fs *FileSessionStore) Put(s *Session) error {
+	path, err := fs.path(s.Id)
+	if err != nil {
+		return err
+	}
+
+	entry := sessionEntry{Id: string(s.Id), Username: s.Username,
+		Version: s.ClientVersion, Expire: time.Now().Add(fs.ttl)}
+	if s.CipherConfig != nil {
+		entry.Cipher = s.CipherConfig.Name
+	}
+	if s.CipherCtx != nil {
+		entry.CryptoKey = s.CipherCtx.CryptoKey
+		entry.IV = s.CipherCtx.IV
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&entry); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, fs.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := fs.aead.Seal(nonce, nonce, buf.Bytes(), []byte(s.Id))
+
+	tmp, err := ioutil.TempFile(fs.dir, ".session-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (fs *FileSessionStore) Get(sid SessionId) (*Session, error) {
+	s, expire, err := fs.load(sid)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if !time.Now().Before(expire) {
+		return nil, fs.Del(sid)
+	}
+	return s, nil
+}
+
+// load opens the session file of sid, it returns nil if there is none
+func (fs *FileSessionStore) load(sid SessionId) (*Session, time.Time, error) {
+	var expire time.Time
+	path, err := fs.path(sid)
+	if err != nil {
+		return nil, expire, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, expire, nil
+		}
+		return nil, expire, err
+	}
+
+	ns := fs.aead.NonceSize()
+	if len(data) < ns {
+		return nil, expire, fmt.Errorf("session %s: entry too short", sid)
+	}
+	plain, err := fs.aead.Open(nil, data[:ns], data[ns:], []byte(sid))
+	if err != nil {
+		return nil, expire, fmt.Errorf("session %s: %s", sid, err.Error())
+	}
+
+	var entry sessionEntry
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&entry); err != nil {
+		return nil, expire, err
+	}
+	if SessionId(entry.Id) != sid {
+		return nil, expire, fmt.Errorf("session %s: id mismatch", sid)
+	}
+
+	s := &Session{Id: sid, Username: entry.Username, ClientVersion: entry.Version}
+	s.CipherCtx = &CipherContext{CryptoKey: entry.CryptoKey, IV: entry.IV}
+	if entry.Cipher != "" {
+		if s.CipherConfig = GetCipherConfig(entry.Cipher); s.CipherConfig == nil {
+			return nil, expire, fmt.Errorf("session %s: no such cipher: %s", sid, entry.Cipher)
+		}
+	}
+	return s, entry.Expire, nil
+}
+
+func (fs *FileSessionStore) Del(sid SessionId) error {
+	path, err := fs.path(sid)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Prune opens every session file of dir, the files it can't open are kept
+// since they may belong to another store key
+func (fs *FileSessionStore) Prune(drop func(s *Session) bool) error {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, fi := range files {
+		bs, err := hex.DecodeString(fi.Name())
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		sid := SessionIdFromBytes(bs)
+		s, expire, err := fs.load(sid)
+		if err != nil || s == nil {
+			continue
+		}
+		if !now.Before(expire) || drop(s) {
+			if err := fs.Del(sid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
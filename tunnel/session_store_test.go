@@ -0,0 +1,264 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, _ := NewCipherContext(5)
+	ctx.MakeF()
+	ctx.CryptoKey = []byte("0123456789abcdef")
+	ctx.IV = []byte("fedcba9876543210")
+	sid, err := ctx.MakeSessionId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Session{Id: sid, Username: "user", CipherCtx: ctx,
+		CipherConfig: GetCipherConfig("aes-128")}
+
+	store, err := NewFileSessionStore(dir, []byte("store key"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second store on the same dir, like another server instance
+	other, _ := NewFileSessionStore(dir, []byte("store key"), time.Hour)
+	got, err := other.Get(sid)
+	if err != nil || got == nil {
+		t.Fatal("get session fail", err)
+	}
+	if got.Username != "user" || got.CipherConfig.Name != "aes-128" ||
+		!bytes.Equal(got.CipherCtx.CryptoKey, ctx.CryptoKey) {
+		t.Error("session not equal", got)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatal("expect 1 session file, got", len(files))
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if bytes.Contains(data, []byte("user")) || bytes.Contains(data, ctx.CryptoKey) {
+		t.Error("session stored in plaintext")
+	}
+
+	wrong, _ := NewFileSessionStore(dir, []byte("wrong key"), time.Hour)
+	if s, err := wrong.Get(sid); err == nil || s != nil {
+		t.Error("open session with wrong key")
+	}
+
+	if err := store.Del(sid); err != nil {
+		t.Error(err)
+	}
+	if s, err := other.Get(sid); err != nil || s != nil {
+		t.Error("session not deleted", s, err)
+	}
+
+	store.Put(s)
+	other.Prune(func(s *Session) bool { return s.Username != "user" })
+	if s, _ := store.Get(sid); s == nil {
+		t.Error("session pruned")
+	}
+	other.Prune(func(s *Session) bool { return s.Username == "user" })
+	if s, _ := store.Get(sid); s != nil {
+		t.Error("session not pruned")
+	}
+
+	// the sessions expire after ttl
+	short, _ := NewFileSessionStore(dir, []byte("store key"), time.Millisecond)
+	short.Put(s)
+	time.Sleep(10 * time.Millisecond)
+	if s, err := store.Get(sid); err != nil || s != nil {
+		t.Error("get expired session", s, err)
+	}
+	short.Put(s)
+	time.Sleep(10 * time.Millisecond)
+	store.Prune(func(*Session) bool { return false })
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Error("expired session not pruned", files)
+	}
+}
+
+// reuseTestSession sends a reuse request of sid signed by key, it returns the
+// reuse_ok and fail_code of the reply
+func reuseTestSession(t *testing.T, addr string, sid, key []byte) (byte, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	random := []byte("0123456789abcdef")
+	mac := hmac.New(sha256.New, key)
+	mac.Write(random)
+	req := []byte{PROTO_MAGIC, byte(len(sid)), byte(len(random)), sha256.Size}
+	req = append(append(append(req, sid...), random...), mac.Sum(nil)...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	rep := make([]byte, 2)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep[0], rep[1]
+}
+
+func TestReuseSessionUser(t *testing.T) {
+	ser, cleanup := newPlainTestServer(t)
+	defer cleanup()
+	addr := ser.listenser.Addr().String()
+
+	key := []byte("0123456789abcdef")
+	sid := []byte("session-1")
+	save := func() {
+		ser.sessions.SaveSession(&Session{Id: SessionIdFromBytes(sid), Username: "user",
+			CipherCtx: &CipherContext{CryptoKey: key}, CipherConfig: GetCipherConfig("aes-256")})
+	}
+	save()
+	if ok, code := reuseTestSession(t, addr, sid, key); ok != B_TRUE || code != REUSE_SUCCESS {
+		t.Error("reuse of an active user", ok, code)
+	}
+
+	users := ser.config.UserConfigPath
+	if err := ioutil.WriteFile(users, []byte("user:\n  password: passwd\n  disabled: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ser.auth.(*UserConfigs).Reload()
+	save()
+	if ok, code := reuseTestSession(t, addr, sid, key); ok != B_FALSE ||
+		code != REUSE_FAIL_START_CIPHER_EXCHANGE|REUSE_FAIL_NO_USER {
+		t.Error("reuse of a disabled user", ok, code)
+	}
+	if ser.sessions.GetSession(SessionIdFromBytes(sid)) != nil {
+		t.Error("session of a disabled user kept")
+	}
+
+	// a new password revokes the sessions of the user
+	save()
+	if err := ioutil.WriteFile(users, []byte("user:\n  password: new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ser.ReloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if ser.sessions.GetSession(SessionIdFromBytes(sid)) != nil {
+		t.Error("session kept after a password change")
+	}
+
+	// sessions of the removed users are dropped by ReloadUsers
+	save()
+	if err := ioutil.WriteFile(users, []byte("other:\n  password: passwd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ser.ReloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if ser.sessions.GetSession(SessionIdFromBytes(sid)) != nil {
+		t.Error("session of a removed user kept")
+	}
+}
+
+func TestReuseSessionRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(users, []byte("user:\n  password: passwd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &ServerConfig{
+		GlobalEncryptMethod:   "aes-128",
+		GlobalEncryptPassword: "passwd",
+		LinkEncryptMethods:    []string{"aes-256"},
+		KeyPath:               filepath.Join(dir, "rsa_key"),
+		UserConfigPath:        users,
+		SessionStore:          SESSION_STORE_FILE,
+		SessionStorePath:      filepath.Join(dir, "sessions"),
+		SessionStoreKey:       "store key"}
+	connected := make(chan SessionId, 1)
+	opts := &ServerOptions{Hooks: ServerHooks{OnConnect: func(s *Session, addr net.Addr) {
+		connected <- s.Id
+	}}}
+	start := func(addr string) *Server {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ser, err := NewServerWithListener(config, l, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ser.Serve(context.Background())
+		return ser
+	}
+	stop := func(ser *Server) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ser.Shutdown(ctx)
+		cancel()
+	}
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	ser := start("127.0.0.1:0")
+	addr := ser.listenser.Addr().String()
+	cli, err := NewClient(newTestClientConfig(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Init(); err != nil {
+		t.Fatal(err)
+	}
+	first := <-connected
+
+	// reconnect to a restarted server, then to one that can't open the
+	// stored session and starts a new login
+	for _, c := range []struct {
+		store_key string
+		reused    bool
+	}{{"store key", true}, {"other key", false}} {
+		stop(ser)
+		config.SessionStoreKey = c.store_key
+		ser = start(addr)
+		for tun := cli.upstreams[0].current(); !tun.isClosed(); {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		conn, err := cli.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Error("echo", err)
+		}
+		conn.Close()
+		if sid := <-connected; (sid == first) != c.reused {
+			t.Error(c.store_key, "session", sid, "first", first)
+		}
+	}
+	stop(ser)
+}
@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+const (
+	TRANSPORT_TCP       = "tcp"
+	TRANSPORT_TLS       = "tls"
+	TRANSPORT_WEBSOCKET = "websocket"
+)
+
+// Transport carries the tunnel between client and server
+type Transport interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// TransportConfig selects the Transport of a server or an upstream
+type TransportConfig struct {
+	// tcp (default), tls or websocket; the websocket client's ServerAddr is
+	// a ws:// or wss:// url, the websocket server uses TLS if TLSCertFile is
+	// set
+	Transport string
+	// server: certificate and key; client: client certificate, optional
+	TLSCertFile string
+	TLSKeyFile  string
+	// client: CA of the server certificate, the system roots if empty;
+	// server: CA of the client certificates, not asked if empty
+	TLSCAFile string
+	// client: SNI, the host of the server address if empty
+	TLSServerName string
+	// ALPN protocols, default http/1.1; the server never speaks h2, so
+	// offering it would give the tunnel away to a prober choosing h2
+	TLSALPN []string
+	// client: skip the certificate check, the server key pin still applies
+	TLSInsecureSkipVerify bool
+	// websocket server: path of the upgrades, default /ws
+	WebSocketPath string
+	// websocket server: html file served on the other paths, a default page
+	// if empty
+	WebSocketDecoyFile string
+}
+
+type TCPTransport struct {
+	Dialer net.Dialer
+}
+
+func (t *TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return t.Dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// TLSTransport is a TCPTransport with TLS, Config must have the
+// certificates for Listen
+type TLSTransport struct {
+	TCPTransport
+	Config *tls.Config
+}
+
+func (t *TLSTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	config := t.Config
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	d := &tls.Dialer{NetDialer: &t.Dialer, Config: config}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (t *TLSTransport) Listen(addr string) (net.Listener, error) {
+	l, err := t.TCPTransport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, t.Config), nil
+}
+
+// NewTransport makes the transport of cfg for a server if is_server or for
+// a client
+func NewTransport(cfg *TransportConfig, is_server bool) (Transport, error) {
+	switch cfg.Transport {
+	case "", TRANSPORT_TCP:
+		return new(TCPTransport), nil
+	case TRANSPORT_TLS:
+		config, err := newTLSConfig(cfg, is_server)
+		if err != nil {
+			return nil, err
+		}
+		return &TLSTransport{Config: config}, nil
+	case TRANSPORT_WEBSOCKET:
+		return newWebSocketTransport(cfg, is_server)
+	}
+	return nil, fmt.Errorf("no such transport: %s (%s, %s or %s)", cfg.Transport,
+		TRANSPORT_TCP, TRANSPORT_TLS, TRANSPORT_WEBSOCKET)
+}
+
+// newTLSConfig makes the tls config of cfg
+func newTLSConfig(cfg *TransportConfig, is_server bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
+		NextProtos:         cfg.TLSALPN,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if cfg.TLSCertFile != "" || is_server {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls certificate fail: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLSCAFile != "" {
+		pem_data, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem_data) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.TLSCAFile)
+		}
+		if is_server {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = pool
+		}
+	}
+	return config, nil
+}
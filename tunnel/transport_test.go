@@ -0,0 +1,208 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate of name and 127.0.0.1
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert_path, key_path := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := writePEMData("CERTIFICATE", der, cert_path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEMData("PRIVATE KEY", key_der, key_path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert_path, key_path
+}
+
+func TestTLSTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTestCert(t, dir, "breaksocks.test")
+
+	transport, err := NewTransport(&TransportConfig{
+		Transport: TRANSPORT_TLS, TLSCertFile: cert, TLSKeyFile: key}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, cleanup := newTestServerOn(t, l, nil)
+	defer cleanup()
+
+	for _, c := range []struct {
+		transport TransportConfig
+		ok        bool
+	}{
+		{TransportConfig{Transport: TRANSPORT_TLS, TLSCAFile: cert, TLSServerName: "breaksocks.test"}, true},
+		{TransportConfig{Transport: TRANSPORT_TLS, TLSCAFile: cert, TLSALPN: []string{"http/1.1"}}, true},
+		{TransportConfig{Transport: TRANSPORT_TLS, TLSServerName: "breaksocks.test"}, false},
+		{TransportConfig{Transport: TRANSPORT_TLS, TLSServerName: "other.test", TLSInsecureSkipVerify: true}, true},
+		{TransportConfig{}, false},
+	} {
+		cfg := newTestClientConfig(ser.listenser.Addr().String())
+		cfg.TransportConfig = c.transport
+		cfg.ServerCheckTimeout = time.Second
+		cli, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Init(); (err == nil) != c.ok {
+			t.Errorf("%+v login: %v", c.transport, err)
+		}
+		cli.Close()
+	}
+
+	// a prober offering h2 must not get it
+	probe, err := tls.Dial("tcp", ser.listenser.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := probe.ConnectionState().NegotiatedProtocol; proto != "http/1.1" {
+		t.Error("negotiated", proto)
+	}
+	probe.Close()
+
+	if _, err := NewTransport(&TransportConfig{Transport: "quic"}, false); err == nil {
+		t.Error("made a quic transport")
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTestCert(t, dir, "breaksocks.test")
+
+	for _, c := range []struct {
+		server TransportConfig
+		scheme string
+		client TransportConfig
+	}{
+		{TransportConfig{Transport: TRANSPORT_WEBSOCKET}, "ws", TransportConfig{}},
+		{TransportConfig{Transport: TRANSPORT_WEBSOCKET, WebSocketPath: "/tunnel",
+			TLSCertFile: cert, TLSKeyFile: key}, "wss", TransportConfig{TLSCAFile: cert}},
+	} {
+		transport, err := NewTransport(&c.server, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := transport.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ser, cleanup := newTestServerOn(t, l, nil)
+		addr := ser.listenser.Addr().String()
+		path := c.server.WebSocketPath
+		if path == "" {
+			path = DEFAULT_WEBSOCKET_PATH
+		}
+
+		cfg := newTestClientConfig(c.scheme + "://" + addr + path)
+		cfg.TransportConfig = c.client
+		cfg.Transport = TRANSPORT_WEBSOCKET
+		cli, err := NewClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Init(); err != nil {
+			t.Fatal(c.scheme, "login", err)
+		}
+
+		// plain requests get the decoy page, fetch it through the tunnel
+		http_cli := &http.Client{Transport: &http.Transport{
+			DialContext:     cli.DialContext,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		scheme := "http"
+		if c.scheme == "wss" {
+			scheme = "https"
+		}
+		for _, p := range []string{"/", path} {
+			resp, err := http_cli.Get(scheme + "://" + addr + p)
+			if err != nil {
+				t.Fatal(c.scheme, p, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 || !bytes.Equal(body, defaultDecoyPage) {
+				t.Errorf("%s %s: %d %q", c.scheme, p, resp.StatusCode, body)
+			}
+		}
+		cli.Close()
+		cleanup()
+	}
+}
+
+func TestWebSocketListenerFail(t *testing.T) {
+	transport, err := NewTransport(&TransportConfig{Transport: TRANSPORT_WEBSOCKET}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the http server exits when the underlying listener fails
+	l.(*wsListener).Listener.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil || err == net.ErrClosed {
+			t.Error("accept", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("accept blocks after the http server exits")
+	}
+}
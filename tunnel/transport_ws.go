@@ -0,0 +1,236 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_WEBSOCKET_PATH = "/ws"
+
+// page served by the websocket server on the paths other than WebSocketPath
+var defaultDecoyPage = []byte(`<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body>
+<h1>Welcome</h1>
+<p>This site is under construction.</p>
+</body>
+</html>
+`)
+
+// WebSocketTransport carries the tunnel in the binary frames of a
+// WebSocket, the server answers the other requests with a decoy page
+type WebSocketTransport struct {
+	TCPTransport
+	// wss:// for the client, TLS listener for the server if not nil
+	TLS   *TLSTransport
+	Path  string
+	Decoy []byte
+}
+
+func newWebSocketTransport(cfg *TransportConfig, is_server bool) (*WebSocketTransport, error) {
+	t := &WebSocketTransport{Path: cfg.WebSocketPath, Decoy: defaultDecoyPage}
+	if t.Path == "" {
+		t.Path = DEFAULT_WEBSOCKET_PATH
+	}
+	if !strings.HasPrefix(t.Path, "/") {
+		return nil, fmt.Errorf("invalid websocket path: %s", t.Path)
+	}
+	if cfg.WebSocketDecoyFile != "" {
+		page, err := ioutil.ReadFile(cfg.WebSocketDecoyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Decoy = page
+	}
+	if !is_server || cfg.TLSCertFile != "" {
+		config, err := newTLSConfig(cfg, is_server)
+		if err != nil {
+			return nil, err
+		}
+		t.TLS = &TLSTransport{Config: config}
+	}
+	return t, nil
+}
+
+// Dial connects to addr, a ws:// or wss:// url
+func (t *WebSocketTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	var dialer Transport
+	origin := "http://" + u.Host
+	port := "80"
+	switch u.Scheme {
+	case "ws":
+		dialer = &t.TCPTransport
+	case "wss":
+		if t.TLS == nil {
+			return nil, fmt.Errorf("%s: no tls config", addr)
+		}
+		dialer, origin, port = t.TLS, "https://"+u.Host, "443"
+	default:
+		return nil, fmt.Errorf("websocket server address must be a ws:// or wss:// url: %s", addr)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	config, err := websocket.NewConfig(addr, origin)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.Dial(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s fail: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return newWSConn(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// Listen serves HTTP on addr, the upgrades on Path are accepted by the
+// returned listener
+func (t *WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if t.TLS != nil {
+		l, err = t.TLS.Listen(addr)
+	} else {
+		l, err = t.TCPTransport.Listen(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		stopped:  make(chan struct{})}
+	ws_server := websocket.Server{Handler: wl.serveConn,
+		// accept the clients without an Origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil }}
+	wl.server = &http.Server{
+		ReadHeaderTimeout: 30 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == t.Path && r.ProtoMajor == 1 &&
+				strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				ws_server.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(t.Decoy)
+		})}
+	go func() {
+		wl.err = wl.server.Serve(l)
+		close(wl.stopped)
+	}()
+	return wl, nil
+}
+
+// wsListener hands the upgraded connections of server to Accept
+type wsListener struct {
+	net.Listener
+	server     *http.Server
+	conns      chan net.Conn
+	closed     chan struct{}
+	close_once sync.Once
+	// closed with err set when the http server exits
+	stopped chan struct{}
+	err     error
+}
+
+func (l *wsListener) serveConn(ws *websocket.Conn) {
+	r := ws.Request()
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	conn := newWSConn(ws, local, remote)
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		return
+	case <-l.stopped:
+		return
+	}
+	// the connection is closed when the handler returns
+	<-conn.done
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.stopped:
+		select {
+		case <-l.closed:
+			return nil, net.ErrClosed
+		default:
+			return nil, l.err
+		}
+	}
+}
+
+func (l *wsListener) Close() error {
+	err := errors.New("listener already closed")
+	l.close_once.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+// wsConn is a websocket.Conn with the addresses of the underlying connection
+type wsConn struct {
+	*websocket.Conn
+	local      net.Addr
+	remote     net.Addr
+	done       chan struct{}
+	close_once sync.Once
+}
+
+func newWSConn(ws *websocket.Conn, local, remote net.Addr) *wsConn {
+	return &wsConn{Conn: ws, local: local, remote: remote, done: make(chan struct{})}
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) Close() error {
+	err := net.ErrClosed
+	c.close_once.Do(func() {
+		err = c.Conn.Close()
+		close(c.done)
+	})
+	return err
+}
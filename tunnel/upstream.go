@@ -0,0 +1,218 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/golang/glog"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SERVER_SELECT_PRIORITY = "priority"
+	SERVER_SELECT_LATENCY  = "latency"
+	SERVER_SELECT_HASH     = "hash"
+)
+
+type upstream struct {
+	idx int
+	cfg UpstreamConfig
+	// DER of the pinned server public key
+	pin       []byte
+	transport Transport
+
+	// held while connecting, so one upstream has one tunnel
+	lock sync.Mutex
+	tun  *ClientTunnel
+
+	state_lock sync.RWMutex
+	alive      bool
+	rtt        time.Duration
+}
+
+func newUpstreams(config *ClientConfig) ([]*upstream, error) {
+	cfgs := config.Servers
+	if len(cfgs) == 0 {
+		cfgs = []UpstreamConfig{{
+			Addr:                config.ServerAddr,
+			Username:            config.Username,
+			Password:            config.Password,
+			ServerPublicKeyPath: config.ServerPublicKeyPath,
+			TransportConfig:     config.TransportConfig}}
+	}
+
+	ups := make([]*upstream, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg.Addr == "" {
+			return nil, fmt.Errorf("server %d: empty addr", i)
+		}
+		if cfg.Transport == "" {
+			cfg.TransportConfig = config.TransportConfig
+		}
+		up := &upstream{idx: i, cfg: cfg, alive: true}
+		var err error
+		if up.transport, err = NewTransport(&cfg.TransportConfig, false); err != nil {
+			return nil, fmt.Errorf("server %s: %s", cfg.Addr, err.Error())
+		}
+		if cfg.ServerPublicKeyPath != "" {
+			pub, err := LoadPublicKey(cfg.ServerPublicKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("server %s: %s", cfg.Addr, err.Error())
+			}
+			if up.pin, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+				return nil, err
+			}
+		}
+		ups[i] = up
+	}
+	return ups, nil
+}
+
+func (up *upstream) state() (bool, time.Duration) {
+	up.state_lock.RLock()
+	defer up.state_lock.RUnlock()
+	return up.alive, up.rtt
+}
+
+func (up *upstream) setAlive(alive bool) {
+	up.state_lock.Lock()
+	if up.alive != alive {
+		glog.Infof("server %s alive: %v", up.cfg.Addr, alive)
+	}
+	up.alive = alive
+	up.state_lock.Unlock()
+}
+
+func (up *upstream) addRTT(rtt time.Duration) {
+	up.state_lock.Lock()
+	if up.rtt == 0 {
+		up.rtt = rtt
+	} else {
+		up.rtt = (up.rtt*7 + rtt*3) / 10
+	}
+	up.state_lock.Unlock()
+}
+
+// tunnel returns the logged in tunnel of up, it connects a new one if there
+// is none or the last one was closed
+func (up *upstream) tunnel(cli *Client) (*ClientTunnel, error) {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if up.tun != nil && !up.tun.isClosed() {
+		return up.tun, nil
+	}
+	tun := NewClientTunnel(cli, up)
+	if up.tun != nil {
+		// resume the session of the closed tunnel
+		tun.session, tun.server_version = up.tun.session, up.tun.server_version
+	}
+	if err := tun.Init(); err != nil {
+		return nil, err
+	}
+	up.tun = tun
+	return tun, nil
+}
+
+func (up *upstream) current() *ClientTunnel {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	return up.tun
+}
+
+// candidates returns the upstreams in the order they should be tried for
+// host, the dead ones are put at the end
+func (cli *Client) candidates(host string) []*upstream {
+	ups := make([]*upstream, len(cli.upstreams))
+	copy(ups, cli.upstreams)
+
+	alive := make(map[*upstream]bool, len(ups))
+	rtts := make(map[*upstream]time.Duration, len(ups))
+	scores := make(map[*upstream]uint64, len(ups))
+	for _, up := range ups {
+		alive[up], rtts[up] = up.state()
+		if rtts[up] == 0 {
+			rtts[up] = time.Duration(1<<63 - 1)
+		}
+		if cli.config.ServerSelect == SERVER_SELECT_HASH {
+			// rendezvous hashing
+			h := fnv.New64a()
+			h.Write([]byte(host))
+			h.Write([]byte{0})
+			h.Write([]byte(up.cfg.Addr))
+			scores[up] = h.Sum64()
+		}
+	}
+
+	sort.SliceStable(ups, func(i, j int) bool {
+		a, b := ups[i], ups[j]
+		if alive[a] != alive[b] {
+			return alive[a]
+		}
+		switch cli.config.ServerSelect {
+		case SERVER_SELECT_LATENCY:
+			if rtts[a] != rtts[b] {
+				return rtts[a] < rtts[b]
+			}
+		case SERVER_SELECT_HASH:
+			return scores[a] > scores[b]
+		}
+		return a.cfg.Priority < b.cfg.Priority
+	})
+	return ups
+}
+
+// pickTunnel returns a tunnel for the new conn to host, the failed
+// upstreams are marked dead
+func (cli *Client) pickTunnel(host string) (*ClientTunnel, error) {
+	var last_err error = ErrClientClosed
+	for _, up := range cli.candidates(host) {
+		if cli.isClosed() {
+			return nil, ErrClientClosed
+		}
+		tun, err := up.tunnel(cli)
+		if err == nil {
+			up.setAlive(true)
+			return tun, nil
+		}
+		glog.Warningf("connect server %s fail: %v", up.cfg.Addr, err)
+		up.setAlive(false)
+		last_err = err
+	}
+	return nil, last_err
+}
+
+func (cli *Client) probeUpstreams() {
+	var wg sync.WaitGroup
+	for _, up := range cli.upstreams {
+		wg.Add(1)
+		go func(up *upstream) {
+			defer wg.Done()
+			rtt, err := NewClientTunnel(cli, up).Probe(cli.config.ServerCheckTimeout)
+			if err != nil {
+				glog.V(1).Infof("probe server %s fail: %v", up.cfg.Addr, err)
+				up.setAlive(false)
+				return
+			}
+			glog.V(2).Infof("probe server %s: %v", up.cfg.Addr, rtt)
+			up.addRTT(rtt)
+			up.setAlive(true)
+		}(up)
+	}
+	wg.Wait()
+}
+
+func (cli *Client) checkUpstreams() {
+	ticker := time.NewTicker(cli.config.ServerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cli.probeUpstreams()
+		case <-cli.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpstreamFailover(t *testing.T) {
+	ser1, cleanup1 := newTestServer(t, nil)
+	ser2, cleanup2 := newTestServer(t, nil)
+	defer cleanup2()
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	cfg := newTestClientConfig("")
+	cfg.Servers = []UpstreamConfig{
+		{Addr: ser1.listenser.Addr().String(), Username: "user", Password: "passwd", Priority: 1},
+		{Addr: ser2.listenser.Addr().String(), Username: "user", Password: "passwd", Priority: 2},
+	}
+	cfg.ServerCheckInterval = time.Hour
+	cli, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if _, rtt := cli.upstreams[0].state(); rtt == 0 {
+		t.Error("server not probed")
+	}
+	tun, err := cli.pickTunnel("")
+	if err != nil || tun.up != cli.upstreams[0] {
+		t.Fatal("expect first server", err)
+	}
+
+	cleanup1()
+	// wait for the tunnel to notice
+	for i := 0; i < 50 && !tun.isClosed(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	conn, err := cli.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if alive, _ := cli.upstreams[0].state(); alive {
+		t.Error("first server should be dead")
+	}
+	if tun, _ := cli.pickTunnel(""); tun == nil || tun.up != cli.upstreams[1] {
+		t.Error("expect second server")
+	}
+}
+
+func TestUpstreamHashSelect(t *testing.T) {
+	cfg := newTestClientConfig("")
+	cfg.ServerSelect = SERVER_SELECT_HASH
+	for _, addr := range []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"} {
+		cfg.Servers = append(cfg.Servers, UpstreamConfig{Addr: addr})
+	}
+	cli, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picked := make(map[*upstream]bool)
+	for _, host := range []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com"} {
+		first := cli.candidates(host)[0]
+		if cli.candidates(host)[0] != first {
+			t.Error("hash select not stable for", host)
+		}
+		picked[first] = true
+	}
+	if len(picked) < 2 {
+		t.Error("hash select always picks the same server")
+	}
+
+	// a dead server only moves its own hosts
+	before := cli.candidates("a.com")
+	before[0].setAlive(false)
+	after := cli.candidates("a.com")
+	if after[0] != before[1] || after[2] != before[0] {
+		t.Error("unexpected order after failure")
+	}
+}
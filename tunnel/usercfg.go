@@ -1,12 +1,60 @@
 package tunnel
 
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
 type UserConfig struct {
-	Password string
+	// plaintext password of hand written files, PasswordHash wins if both set
+	Password     string `yaml:"password,omitempty"`
+	PasswordHash string `yaml:"passwordhash,omitempty"`
+	Disabled     bool   `yaml:"disabled,omitempty"`
+	// max concurrent tunnels and proxied connections, 0 is unlimited
+	MaxTunnels int `yaml:"maxtunnels,omitempty"`
+	MaxConns   int `yaml:"maxconns,omitempty"`
+}
+
+// SetPassword replaces the password by its hash
+func (cfg *UserConfig) SetPassword(passwd string) error {
+	hash, err := HashPassword(passwd)
+	if err != nil {
+		return err
+	}
+	cfg.Password = ""
+	cfg.PasswordHash = hash
+	return nil
 }
 
+func (cfg *UserConfig) checkPassword(passwd string) bool {
+	if cfg.PasswordHash != "" {
+		return CheckPasswordHash(cfg.PasswordHash, passwd)
+	}
+	return cfg.Password != "" && subtle.ConstantTimeCompare([]byte(cfg.Password), []byte(passwd)) == 1
+}
+
+// MAX_PASSWORD_CHECKS bounds the concurrent password hash checks, the others wait
+const MAX_PASSWORD_CHECKS = 4
+
+var passwordChecks = make(chan struct{}, MAX_PASSWORD_CHECKS)
+
 type UserConfigs struct {
 	path  string
+	lock  sync.RWMutex
 	users map[string]*UserConfig
+	// user -> sha256 of the hash and password of its last verified login
+	verified sync.Map
+}
+
+// NewUserConfigs makes an empty users file at path, written by Save
+func NewUserConfigs(path string) *UserConfigs {
+	return &UserConfigs{path: path, users: make(map[string]*UserConfig)}
 }
 
 func GetUserConfigs(path string) (*UserConfigs, error) {
@@ -24,10 +72,115 @@ func (cfgs *UserConfigs) Reload() error {
 		return err
 	}
 
+	cfgs.lock.Lock()
 	cfgs.users = new_pass
+	cfgs.lock.Unlock()
 	return nil
 }
 
+// Save writes the users to the file they were loaded from, readers see
+// either the old or the new file
+func (cfgs *UserConfigs) Save() error {
+	cfgs.lock.RLock()
+	data, err := yaml.Marshal(cfgs.users)
+	cfgs.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(cfgs.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(cfgs.path), filepath.Base(cfgs.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err == nil {
+		if err = f.Chmod(mode); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cfgs.path)
+}
+
+// Get returns a copy of the config of user, nil if there is no such user
 func (cfgs *UserConfigs) Get(user string) *UserConfig {
-	return cfgs.users[user]
+	cfgs.lock.RLock()
+	defer cfgs.lock.RUnlock()
+	if user_cfg := cfgs.users[user]; user_cfg != nil {
+		cfg := *user_cfg
+		return &cfg
+	}
+	return nil
+}
+
+func (cfgs *UserConfigs) Set(user string, cfg *UserConfig) {
+	cfgs.lock.Lock()
+	cfgs.users[user] = cfg
+	cfgs.lock.Unlock()
+}
+
+func (cfgs *UserConfigs) Delete(user string) {
+	cfgs.lock.Lock()
+	delete(cfgs.users, user)
+	cfgs.lock.Unlock()
+}
+
+// Authenticate checks the password of user, verified passwords skip the
+// hash check so that failed logins can't starve the known ones
+func (cfgs *UserConfigs) Authenticate(user, passwd string) bool {
+	user_cfg := cfgs.Get(user)
+	if user_cfg == nil || user_cfg.Disabled {
+		return false
+	}
+	if user_cfg.PasswordHash == "" {
+		return user_cfg.checkPassword(passwd)
+	}
+	sum := sha256.Sum256([]byte(user_cfg.PasswordHash + "\x00" + passwd))
+	if v, ok := cfgs.verified.Load(user); ok {
+		last := v.([sha256.Size]byte)
+		if subtle.ConstantTimeCompare(last[:], sum[:]) == 1 {
+			return true
+		}
+	}
+	passwordChecks <- struct{}{}
+	ok := user_cfg.checkPassword(passwd)
+	<-passwordChecks
+	if ok {
+		cfgs.verified.Store(user, sum)
+	}
+	return ok
+}
+
+// Active reports whether user exists and is not disabled
+func (cfgs *UserConfigs) Active(user string) bool {
+	user_cfg := cfgs.Get(user)
+	return user_cfg != nil && !user_cfg.Disabled
+}
+
+func (cfgs *UserConfigs) Limits(user string) (max_tunnels, max_conns int) {
+	if user_cfg := cfgs.Get(user); user_cfg != nil {
+		return user_cfg.MaxTunnels, user_cfg.MaxConns
+	}
+	return 0, 0
+}
+
+// Names returns the sorted user names
+func (cfgs *UserConfigs) Names() []string {
+	cfgs.lock.RLock()
+	names := make([]string, 0, len(cfgs.users))
+	for name := range cfgs.users {
+		names = append(names, name)
+	}
+	cfgs.lock.RUnlock()
+	sort.Strings(names)
+	return names
 }
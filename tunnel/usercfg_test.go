@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(path, []byte("bob:\n  password: x\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := GetUserConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &UserConfig{MaxTunnels: 1}
+	if err := alice.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	users.Set("alice", alice)
+	users.Set("carol", &UserConfig{Password: "y", Disabled: true})
+	if err := users.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := GetUserConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, passwd string
+		ok           bool
+	}{
+		{"bob", "x", true},
+		{"bob", "y", false},
+		{"alice", "secret", true},
+		{"alice", "secrets", false},
+		{"carol", "y", false},
+		{"dave", "", false},
+	} {
+		if saved.Authenticate(c.user, c.passwd) != c.ok {
+			t.Error("authenticate", c.user, c.passwd, !c.ok)
+		}
+	}
+	if saved.Get("alice").Password != "" {
+		t.Error("plaintext password saved")
+	}
+
+	limiter := newUserLimiter(saved)
+	if !limiter.acquireTunnel("alice") || limiter.acquireTunnel("alice") || !limiter.tunnelsFull("alice") {
+		t.Error("alice is limited to 1 tunnel")
+	}
+	limiter.releaseTunnel("alice")
+	if limiter.tunnelsFull("alice") || !limiter.acquireConn("alice") {
+		t.Error("released tunnel still counted")
+	}
+}
+
+func TestPasswordChecksLimit(t *testing.T) {
+	users := NewUserConfigs("")
+	alice := &UserConfig{}
+	if err := alice.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	users.Set("alice", alice)
+	if !users.Authenticate("alice", "secret") {
+		t.Fatal("alice not authenticated")
+	}
+
+	for i := 0; i < MAX_PASSWORD_CHECKS; i++ {
+		passwordChecks <- struct{}{}
+	}
+	// the verified password needs no check slot
+	if !users.Authenticate("alice", "secret") {
+		t.Error("verified password refused")
+	}
+	done := make(chan bool, 1)
+	go func() { done <- users.Authenticate("alice", "wrong") }()
+	select {
+	case <-done:
+		t.Fatal("password checked beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-passwordChecks
+	if <-done {
+		t.Error("wrong password accepted")
+	}
+	for i := 1; i < MAX_PASSWORD_CHECKS; i++ {
+		<-passwordChecks
+	}
+}